@@ -0,0 +1,283 @@
+// Package agent implements a short-lived in-memory passphrase cache, similar in spirit to ssh-agent, so that a
+// passphrase need only be entered once when running several saltybox commands in a row.
+//
+// The agent serves a single cached passphrase over a unix domain socket, never over the network. The socket is
+// created accessible only by the owner, and connections from processes running as any other user are rejected by
+// checking the peer's credentials. This check is only supported on Linux and macOS; elsewhere every connection is
+// rejected. The passphrase expires after a configurable TTL measured from when it was stored, at which point it is
+// zeroed in memory.
+//
+// The protocol is line based. A request is "GET", "PUT <base64 passphrase>" or "CLEAR". Responses are "OK" (to
+// PUT and CLEAR), "OK <base64 passphrase>" or "NONE" (to GET) and "ERR <message>".
+package agent
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SocketEnv is the environment variable used to communicate the path of the agent's socket to clients.
+const SocketEnv = "SALTYBOX_AGENT_SOCK"
+
+// Maximum length of a request line, which bounds the size of a cached passphrase.
+const maxLineLen = 64 * 1024
+
+type cache struct {
+	mu  sync.Mutex
+	ttl time.Duration
+
+	// passphrase is held as bytes so that it can be zeroed once no longer needed. It is only valid while expires
+	// is non-zero.
+	passphrase []byte
+	expires    time.Time
+	timer      *time.Timer
+}
+
+func (c *cache) get(now time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.expires.IsZero() || !now.Before(c.expires) {
+		c.wipe()
+		return "", false
+	}
+
+	return string(c.passphrase), true
+}
+
+// put caches passphrase, taking ownership of it: it is zeroed when it expires or is replaced or cleared.
+func (c *cache) put(now time.Time, passphrase []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.wipe()
+	c.passphrase = passphrase
+	c.expires = now.Add(c.ttl)
+	c.timer = time.AfterFunc(c.ttl, c.expire)
+}
+
+func (c *cache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.wipe()
+}
+
+// expire wipes the passphrase once it has expired, so that it does not linger in memory until the next request.
+func (c *cache) expire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The passphrase may have been replaced since the timer was started.
+	if !c.expires.IsZero() && !time.Now().Before(c.expires) {
+		c.wipe()
+	}
+}
+
+// wipe zeroes and forgets the cached passphrase. c.mu must be held.
+func (c *cache) wipe() {
+	for i := range c.passphrase {
+		c.passphrase[i] = 0
+	}
+	c.passphrase = nil
+	c.expires = time.Time{}
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+// Listen creates the agent's socket at socketPath, accessible only by the owner. The socket must not already
+// exist.
+func Listen(socketPath string) (net.Listener, error) {
+	// Created under a restrictive umask rather than restricted afterwards, so that there is no window in which
+	// other users could connect.
+	var l net.Listener
+	err := withUmask(0177, func() (err error) {
+		l, err = net.Listen("unix", socketPath)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %s", socketPath, err)
+	}
+
+	// Platforms without a umask rely on this instead (and on the peer credential check).
+	if err = os.Chmod(socketPath, 0600); err != nil {
+		_ = l.Close()
+		return nil, fmt.Errorf("failed to restrict permissions of %s: %s", socketPath, err)
+	}
+
+	return l, nil
+}
+
+// Serve serves requests on l (see Listen) until l is closed, caching a passphrase for ttl after it is stored.
+func Serve(l net.Listener, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive, was %s", ttl)
+	}
+
+	c := &cache{ttl: ttl}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go handle(conn, c)
+	}
+}
+
+func handle(conn net.Conn, c *cache) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if err := checkPeer(conn); err != nil {
+		_, _ = fmt.Fprintf(conn, "ERR %s\n", err)
+		return
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), maxLineLen)
+	for scanner.Scan() {
+		if _, err := fmt.Fprintln(conn, respond(scanner.Text(), c)); err != nil {
+			return
+		}
+	}
+}
+
+func respond(request string, c *cache) string {
+	switch {
+	case request == "GET":
+		passphrase, ok := c.get(time.Now())
+		if !ok {
+			return "NONE"
+		}
+		return "OK " + base64.StdEncoding.EncodeToString([]byte(passphrase))
+	case strings.HasPrefix(request, "PUT "):
+		passphrase, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(request, "PUT "))
+		if err != nil {
+			return "ERR invalid passphrase encoding"
+		}
+		c.put(time.Now(), passphrase)
+		return "OK"
+	case request == "CLEAR":
+		c.clear()
+		return "OK"
+	default:
+		return "ERR unrecognized request"
+	}
+}
+
+// checkPeer returns an error unless the process at the other end of conn runs as the same user as the agent.
+func checkPeer(conn net.Conn) error {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return errors.New("not a unix socket connection")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("failed to determine peer credentials: %s", err)
+	}
+
+	var uid int
+	var uidErr error
+	if err = raw.Control(func(fd uintptr) {
+		uid, uidErr = peerUID(int(fd))
+	}); err != nil {
+		return fmt.Errorf("failed to determine peer credentials: %s", err)
+	}
+	if uidErr != nil {
+		return fmt.Errorf("failed to determine peer credentials: %s", uidErr)
+	}
+	if uid != os.Getuid() {
+		return fmt.Errorf("permission denied for uid %d", uid)
+	}
+
+	return nil
+}
+
+func roundTrip(socketPath string, request string) (string, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to agent at %s: %s", socketPath, err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if _, err = fmt.Fprintln(conn, request); err != nil {
+		return "", fmt.Errorf("failed to send request to agent: %s", err)
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), maxLineLen)
+	if !scanner.Scan() {
+		if err = scanner.Err(); err != nil {
+			return "", fmt.Errorf("failed to read response from agent: %s", err)
+		}
+		return "", errors.New("agent closed the connection without responding")
+	}
+
+	response := scanner.Text()
+	if strings.HasPrefix(response, "ERR ") {
+		return "", fmt.Errorf("agent error: %s", strings.TrimPrefix(response, "ERR "))
+	}
+
+	return response, nil
+}
+
+// Get asks the agent listening at socketPath for the cached passphrase. If there is none (or it has expired),
+// ok is false.
+func Get(socketPath string) (passphrase string, ok bool, err error) {
+	response, err := roundTrip(socketPath, "GET")
+	if err != nil {
+		return "", false, err
+	}
+	if response == "NONE" {
+		return "", false, nil
+	}
+	if !strings.HasPrefix(response, "OK ") {
+		return "", false, fmt.Errorf("unexpected response from agent: %q", response)
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(response, "OK "))
+	if err != nil {
+		return "", false, fmt.Errorf("invalid passphrase encoding in response from agent: %s", err)
+	}
+
+	return string(decoded), true, nil
+}
+
+// Put stores passphrase in the agent listening at socketPath, replacing any previously cached passphrase.
+func Put(socketPath string, passphrase string) error {
+	response, err := roundTrip(socketPath, "PUT "+base64.StdEncoding.EncodeToString([]byte(passphrase)))
+	if err != nil {
+		return err
+	}
+	if response != "OK" {
+		return fmt.Errorf("unexpected response from agent: %q", response)
+	}
+
+	return nil
+}
+
+// Clear removes any cached passphrase from the agent listening at socketPath, such as one that was mistyped.
+func Clear(socketPath string) error {
+	response, err := roundTrip(socketPath, "CLEAR")
+	if err != nil {
+		return err
+	}
+	if response != "OK" {
+		return fmt.Errorf("unexpected response from agent: %q", response)
+	}
+
+	return nil
+}
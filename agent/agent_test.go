@@ -0,0 +1,132 @@
+package agent
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startAgent(t *testing.T, ttl time.Duration) string {
+	dir, err := ioutil.TempDir("", "saltyboxtest")
+	if !assert.NoError(t, err) {
+		assert.FailNow(t, "failed to create temporary directory")
+	}
+
+	socketPath := filepath.Join(dir, "agent.sock")
+	l, err := Listen(socketPath)
+	if !assert.NoError(t, err) {
+		assert.FailNow(t, "failed to listen")
+	}
+	go func() {
+		_ = Serve(l, ttl)
+	}()
+
+	t.Cleanup(func() {
+		assert.NoError(t, l.Close())
+		assert.NoError(t, os.RemoveAll(dir))
+	})
+
+	return socketPath
+}
+
+func TestAgent(t *testing.T) {
+	socketPath := startAgent(t, time.Hour)
+
+	info, err := os.Stat(socketPath)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	_, ok, err := Get(socketPath)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// Arbitrary bytes, including whitespace, must survive.
+	err = Put(socketPath, "pass phrase\n")
+	assert.NoError(t, err)
+
+	passphrase, ok, err := Get(socketPath)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "pass phrase\n", passphrase)
+
+	err = Put(socketPath, "")
+	assert.NoError(t, err)
+	passphrase, ok, err = Get(socketPath)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "", passphrase)
+
+	err = Clear(socketPath)
+	assert.NoError(t, err)
+	_, ok, err = Get(socketPath)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestAgentExpiry(t *testing.T) {
+	socketPath := startAgent(t, 50*time.Millisecond)
+
+	err := Put(socketPath, "passphrase")
+	assert.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	_, ok, err := Get(socketPath)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestCacheWipedOnExpiry(t *testing.T) {
+	c := &cache{ttl: 20 * time.Millisecond}
+	passphrase := []byte("passphrase")
+	c.put(time.Now(), passphrase)
+
+	// Wiped by the timer, without any further request.
+	time.Sleep(100 * time.Millisecond)
+	c.mu.Lock()
+	assert.Nil(t, c.passphrase)
+	c.mu.Unlock()
+	assert.Equal(t, make([]byte, len(passphrase)), passphrase)
+
+	// Replacing and clearing also wipe the previous passphrase.
+	c.ttl = time.Hour
+	first := []byte("first")
+	c.put(time.Now(), first)
+	second := []byte("second")
+	c.put(time.Now(), second)
+	assert.Equal(t, make([]byte, len(first)), first)
+	c.clear()
+	assert.Equal(t, make([]byte, len(second)), second)
+}
+
+func TestAgentRejectsUnverifiedPeers(t *testing.T) {
+	// A connection whose peer credentials cannot be determined is rejected.
+	client, server := net.Pipe()
+	go handle(server, &cache{ttl: time.Hour})
+
+	response, err := bufio.NewReader(client).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "ERR not a unix socket connection\n", response)
+	assert.NoError(t, client.Close())
+}
+
+func TestAgentErrors(t *testing.T) {
+	socketPath := startAgent(t, time.Hour)
+
+	_, err := roundTrip(socketPath, "NONSENSE")
+	assert.Error(t, err)
+	_, err = roundTrip(socketPath, "PUT !!!")
+	assert.Error(t, err)
+
+	_, _, err = Get(filepath.Join(filepath.Dir(socketPath), "missing.sock"))
+	assert.Error(t, err)
+
+	err = Serve(nil, 0)
+	assert.Error(t, err)
+}
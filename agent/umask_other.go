@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package agent
+
+// withUmask runs f. There is no umask on this platform.
+func withUmask(mask int, f func() error) error {
+	return f()
+}
@@ -0,0 +1,15 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package agent
+
+import "golang.org/x/sys/unix"
+
+// withUmask runs f with the process umask set to mask, restoring it afterwards. The umask is process-wide, so
+// this must not race with other goroutines creating files.
+func withUmask(mask int, f func() error) error {
+	old := unix.Umask(mask)
+	defer unix.Umask(old)
+
+	return f()
+}
@@ -0,0 +1,46 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/atotto/clipboard"
+)
+
+// systemClipboard abstracts the system clipboard, so that tests can substitute an in-memory implementation.
+type systemClipboard interface {
+	ReadAll() ([]byte, error)
+	WriteAll(data []byte) error
+}
+
+// clip is the clipboard used by all commands. It is only ever replaced by tests.
+var clip systemClipboard = atottoClipboard{}
+
+// atottoClipboard accesses the system clipboard using github.com/atotto/clipboard. It uses the native API on
+// Windows, and pbcopy and pbpaste on macOS. Elsewhere it runs wl-copy and wl-paste (under Wayland), xclip or xsel,
+// so systems without any of these (such as headless servers) have no usable clipboard.
+//
+// Clipboard managers may keep a history of everything placed on the clipboard, which clearing the clipboard does
+// not remove.
+type atottoClipboard struct{}
+
+func (atottoClipboard) ReadAll() ([]byte, error) {
+	text, err := clipboard.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(text), nil
+}
+
+func (atottoClipboard) WriteAll(data []byte) error {
+	return clipboard.WriteAll(string(data))
+}
+
+// clearClipboard empties the clipboard, such as after its contents have been encrypted. Failure is reported on
+// stderr rather than returned, since the operation which read the clipboard has already succeeded.
+func clearClipboard() {
+	if err := clip.WriteAll(nil); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to clear the plain text from the clipboard (%s); clear it manually\n", err)
+	}
+}
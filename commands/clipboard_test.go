@@ -0,0 +1,85 @@
+package commands
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/scode/saltybox/preader"
+	"github.com/stretchr/testify/assert"
+)
+
+// memClipboard is an in-memory clipboard.
+type memClipboard struct {
+	data   []byte
+	writes int
+
+	// writeErr causes writes to the clipboard to fail with this error.
+	writeErr error
+}
+
+func (c *memClipboard) ReadAll() ([]byte, error) {
+	return c.data, nil
+}
+
+func (c *memClipboard) WriteAll(data []byte) error {
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+	c.writes++
+	c.data = append([]byte(nil), data...)
+	return nil
+}
+
+func useClipboard(t *testing.T, c systemClipboard) {
+	previous := clip
+	clip = c
+	t.Cleanup(func() {
+		clip = previous
+	})
+}
+
+func TestEncryptClipboard(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+	mc := &memClipboard{data: []byte("super secret")}
+	useClipboard(t, mc)
+
+	err := Encrypt("", "", preader.NewConstant("test"), EncryptOptions{FromClipboard: true, ToClipboard: true})
+	assert.NoError(t, err)
+	assert.Empty(t, mfs.files)
+	assert.Equal(t, 1, mc.writes)
+
+	plaintext, err := decryptString("test", string(mc.data))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("super secret"), plaintext)
+
+	// When the output goes elsewhere, the plain text is cleared from the clipboard.
+	mc.data = []byte("super secret")
+	err = Encrypt("", "encrypted", preader.NewConstant("test"), EncryptOptions{FromClipboard: true})
+	assert.NoError(t, err)
+	assert.Empty(t, mc.data)
+	err = Decrypt("encrypted", "plain", preader.NewConstant("test"), DecryptOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("super secret"), mfs.files["plain"])
+
+	// Failure to clear the clipboard is not an error.
+	mc.data = []byte("super secret")
+	mc.writeErr = errors.New("clipboard unavailable")
+	err = Encrypt("", "encrypted", preader.NewConstant("test"), EncryptOptions{FromClipboard: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("super secret"), mc.data)
+
+	// But failure to write the output to it is.
+	err = Encrypt("plain", "", preader.NewConstant("test"), EncryptOptions{ToClipboard: true})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "clipboard unavailable")
+
+	err = Encrypt("plain", "", preader.NewConstant("test"), EncryptOptions{FromClipboard: true, ToClipboard: true})
+	assert.Error(t, err)
+	err = Encrypt("", "encrypted", preader.NewConstant("test"), EncryptOptions{ToClipboard: true})
+	assert.Error(t, err)
+	err = Encrypt("", "", preader.NewConstant("test"), EncryptOptions{ToClipboard: true, Stdout: true})
+	assert.Error(t, err)
+	err = Encrypt("", "", preader.NewConstant("test"), EncryptOptions{ToClipboard: true, VerifyAfterWrite: true})
+	assert.Error(t, err)
+}
@@ -1,16 +1,231 @@
 package commands
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"image/png"
+	"io"
 	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
 
+	"filippo.io/age"
+	ageArmor "filippo.io/age/armor"
+	"github.com/scode/saltybox/agent"
 	"github.com/scode/saltybox/preader"
 	"github.com/scode/saltybox/secretcrypt"
+	"github.com/scode/saltybox/shamir"
+	"github.com/scode/saltybox/stego"
 	"github.com/scode/saltybox/varmor"
+	"golang.org/x/crypto/nacl/secretbox"
+	"gopkg.in/yaml.v3"
 )
 
+// EncryptOptions controls optional behavior of Encrypt.
+type EncryptOptions struct {
+	// Estimate causes an estimate of the key derivation time to be printed to stderr before encrypting.
+	Estimate bool
+
+	// Mkdir causes the parent directory of the output to be created if it does not exist.
+	Mkdir bool
+
+	// VerifyAfterWrite causes the output to be read back and decrypted after writing, failing unless the result
+	// is identical to the original plain text.
+	VerifyAfterWrite bool
+
+	// OnlyIfChanged causes encryption to be skipped (without reading the passphrase) if the plain text is
+	// unchanged since it was last encrypted to the same output. This is tracked by a salted hash of the plain
+	// text stored in a sidecar file next to the output (see metaPath).
+	OnlyIfChanged bool
+
+	// ArmorEncoding is the name of the armor encoding to use (see varmor.Encodings). Empty means the default.
+	ArmorEncoding string
+
+	// NoEmptyPassphrase causes encryption to be refused if the passphrase is empty, since an empty passphrase
+	// provides essentially no protection.
+	NoEmptyPassphrase bool
+
+	// Stdout causes the armored output to be written to stdout, followed by a newline, instead of to a file. The
+	// output path must then be empty.
+	Stdout bool
+
+	// AlsoOutputs are additional paths to write the same output to. Like the primary output, each is written
+	// atomically, and none replaces its target until all outputs (and any signatures) have been written, so that a
+	// failure leaves existing files as they were.
+	AlsoOutputs []string
+
+	// SignKeyFile, if non-empty, is the path to a key used to write a detached signature (an HMAC-SHA256 of the
+	// output) next to each output (see sigPath). This allows verifying the integrity of the output without the
+	// passphrase (see VerifySignature), to anyone holding the signing key.
+	SignKeyFile string
+
+	// Mmap causes the input to be memory mapped rather than read into memory, avoiding a copy of large inputs.
+	// If the input cannot be mapped (for example because it is not a regular file, or on unsupported platforms)
+	// it is read normally. Note that the encrypted output is still held in memory in its entirety.
+	Mmap bool
+
+	// FromClipboard causes the plain text to be read from the system clipboard (see atottoClipboard) instead of
+	// from a file. The input path must then be empty. Once encrypted, the plain text is cleared from the clipboard
+	// unless it is replaced by the output (see ToClipboard). Failure to clear it is reported on stderr.
+	FromClipboard bool
+
+	// ToClipboard causes the armored output to be placed on the system clipboard instead of written to a file.
+	// The output path must then be empty.
+	ToClipboard bool
+}
+
+// DecryptOptions controls optional behavior of Decrypt.
+type DecryptOptions struct {
+	// Estimate causes an estimate of the key derivation time to be printed to stderr before decrypting.
+	Estimate bool
+
+	// SecureTmp causes the output to be written to a new private directory within a RAM-backed directory (such
+	// as $XDG_RUNTIME_DIR or /dev/shm) rather than to outpath. Only the base name of outpath is used, and the
+	// path written to is reported on stderr. Decryption fails if no RAM-backed directory is available, rather
+	// than falling back to persistent storage.
+	SecureTmp bool
+
+	// Mkdir causes the parent directory of the output to be created if it does not exist.
+	Mkdir bool
+
+	// HTTPHeaders are extra headers, each of the form "Name: value", sent when the input is an HTTP(S) URL.
+	HTTPHeaders []string
+
+	// CAFile is the path to a file of PEM encoded certificates to trust, instead of the system roots, when the
+	// input is an HTTPS URL.
+	CAFile string
+
+	// Strict causes the input to be rejected, before reading the passphrase, unless it is in canonical armored
+	// form (see varmor.UnwrapStrict). Note that this rejects a trailing newline.
+	Strict bool
+
+	// NoArmor causes the input to be treated as raw secretcrypt bytes rather than as armored text (see
+	// ImportRaw).
+	NoArmor bool
+
+	// ExpectFormat, if non-empty, causes decryption to fail (without writing any output) unless the plain text
+	// parses as the given format: "json" or "yaml".
+	ExpectFormat string
+
+	// TryNewlineVariants causes decryption, if it fails with the passphrase as given, to be retried with common
+	// accidental variants of it (see newlineVariants). The variant which succeeded is reported on stderr.
+	TryNewlineVariants bool
+
+	// MaxAge, if non-empty, causes decryption to be refused (before reading the passphrase) if the input was last
+	// modified longer ago than this (see parseAge), as a nudge to rotate old secrets. The file modification time
+	// is used since the format does not record when a file was encrypted; copying a file without preserving its
+	// modification time therefore resets its age. MaxAge cannot be used with URL inputs.
+	MaxAge string
+}
+
+// CommandError is returned by commands (such as Encrypt, Decrypt and Update) when an operation on a particular
+// path fails, so that callers can tell which file was involved using errors.As.
+type CommandError struct {
+	// Op is the operation that failed, such as "read from", "write to" or "decrypt".
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("failed to %s %s: %s", e.Op, e.Path, e.Err)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// stdout is where output requested to go to stdout is written. Replaced by tests.
+var stdout io.Writer = os.Stdout
+
+// checkPaths returns a helpful error if inpath or outpath refer to directories rather than files, which would
+// otherwise result in obscure errors when reading or writing.
+func checkPaths(inpath string, outpath string) error {
+	if info, err := fsys.Stat(inpath); err == nil && info.IsDir() {
+		return fmt.Errorf("input %s is a directory; only files are supported", inpath)
+	}
+	if info, err := fsys.Stat(outpath); err == nil && info.IsDir() {
+		return fmt.Errorf("output %s is an existing directory; specify the path of a file to write to", outpath)
+	}
+
+	return nil
+}
+
+// ensureOutputDir checks that the directory outpath would be written to exists, creating it if mkdir is true.
+func ensureOutputDir(outpath string, mkdir bool) error {
+	dir := filepath.Dir(outpath)
+	if _, err := fsys.Stat(dir); !os.IsNotExist(err) {
+		// Any other error is left to surface when writing.
+		return nil
+	}
+
+	if !mkdir {
+		return fmt.Errorf("output directory does not exist: %s (create it or pass --mkdir)", dir)
+	}
+
+	if err := fsys.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create output directory %s: %s", dir, err)
+	}
+
+	return nil
+}
+
+// checkWritable returns a helpful error if outpath cannot be written due to permissions, so that this is
+// detected before the expensive work of key derivation. Outputs are written by renaming a tempfile over them (see
+// writeFileAtomically), which requires write access to the directory rather than to the file. Other problems are
+// left to surface when writing.
+func checkWritable(outpath string) error {
+	denied := fmt.Errorf("cannot write to %s: permission denied (check file/directory permissions)", outpath)
+
+	// Probe the directory the same way writeFileAtomically (or the creation of a new file) would use it.
+	dir := filepath.Dir(outpath)
+	probe, err := fsys.TempFile(dir, "saltybox-probe")
+	if os.IsPermission(err) {
+		return denied
+	} else if err != nil {
+		return nil
+	}
+	_ = probe.Close()
+	if err = fsys.Remove(probe.Name()); err != nil {
+		return fmt.Errorf("failed to remove %s: %s", probe.Name(), err)
+	}
+
+	return nil
+}
+
+func printEstimate() error {
+	estimate, err := secretcrypt.EstimateKeyDerivation()
+	if err != nil {
+		return fmt.Errorf("failed to estimate key derivation time: %s", err)
+	}
+
+	_, err = fmt.Fprintf(os.Stderr, "Key derivation estimate: this will take ~%.1fs\n", estimate.Seconds())
+	return err
+}
+
 func encryptBytes(passphrase string, plaintext []byte) (string, error) {
 	cipherBytes, err := secretcrypt.Encrypt(passphrase, plaintext)
 	if err != nil {
@@ -22,129 +237,2230 @@ func encryptBytes(passphrase string, plaintext []byte) (string, error) {
 	return string(varmoredBytes), nil
 }
 
-func Encrypt(inpath string, outpath string, preader preader.PassphraseReader) error {
-	plaintext, err := ioutil.ReadFile(inpath)
+// encryptBytesWith is like encryptBytes, but armors using the named encoding (default if empty).
+func encryptBytesWith(passphrase string, plaintext []byte, armorEncoding string) (string, error) {
+	if armorEncoding == "" {
+		return encryptBytes(passphrase, plaintext)
+	}
+
+	cipherBytes, err := secretcrypt.Encrypt(passphrase, plaintext)
 	if err != nil {
-		return fmt.Errorf("failed to read from %s: %s", inpath, err)
+		return "", fmt.Errorf("encryption failed: %s", err)
+	}
+
+	return varmor.WrapWith(armorEncoding, cipherBytes)
+}
+
+// checkArmorEncoding returns an error if armorEncoding is neither empty nor a supported encoding.
+func checkArmorEncoding(armorEncoding string) error {
+	if armorEncoding == "" {
+		return nil
+	}
+	for _, name := range varmor.Encodings() {
+		if name == armorEncoding {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unsupported armor encoding %q; supported encodings are: %s", armorEncoding, strings.Join(varmor.Encodings(), ", "))
+}
+
+// readInput returns the contents of inpath, memory mapped if mmap is true and mapping is possible. The returned
+// function must be called once the contents is no longer used.
+func readInput(inpath string, mmap bool) ([]byte, func() error, error) {
+	// Mapping bypasses fsys, so it is only attempted when fsys is the real filesystem.
+	if _, isOS := fsys.(osFileSystem); mmap && isOS {
+		if data, unmap, err := mmapFile(inpath); err == nil {
+			return data, unmap, nil
+		}
+	}
+
+	data, err := fsys.ReadFile(inpath)
+	if err != nil {
+		return nil, nil, &CommandError{Op: "read from", Path: inpath, Err: err}
+	}
+
+	return data, func() error { return nil }, nil
+}
+
+func Encrypt(inpath string, outpath string, preader preader.PassphraseReader, opts EncryptOptions) (err error) {
+	if err := checkPaths(inpath, outpath); err != nil {
+		return err
+	}
+	if err := checkArmorEncoding(opts.ArmorEncoding); err != nil {
+		return err
+	}
+	if opts.Stdout && outpath != "" {
+		return errors.New("cannot write to both an output file and stdout")
+	}
+	if opts.ToClipboard && (outpath != "" || opts.Stdout) {
+		return errors.New("cannot write to both the clipboard and an output file or stdout")
+	}
+	if opts.FromClipboard && inpath != "" {
+		return errors.New("cannot read from both an input file and the clipboard")
+	}
+	if opts.Stdout || opts.ToClipboard {
+		if opts.Mkdir || opts.VerifyAfterWrite || opts.OnlyIfChanged || len(opts.AlsoOutputs) > 0 || opts.SignKeyFile != "" {
+			return errors.New("--mkdir, --verify-after-write, --only-if-changed, --also-output and --sign-key require an output file")
+		}
+	}
+	var signKey []byte
+	if opts.SignKeyFile != "" {
+		var err error
+		if signKey, err = readSignKey(opts.SignKeyFile); err != nil {
+			return err
+		}
+	}
+	for _, alsoOutpath := range opts.AlsoOutputs {
+		if err := checkPaths(inpath, alsoOutpath); err != nil {
+			return err
+		}
+	}
+
+	source := inpath
+	var plaintext []byte
+	if opts.FromClipboard {
+		source = "clipboard contents"
+		if plaintext, err = clip.ReadAll(); err != nil {
+			return fmt.Errorf("failed to read from clipboard: %s", err)
+		}
+		if !opts.ToClipboard {
+			defer func() {
+				if err == nil {
+					clearClipboard()
+				}
+			}()
+		}
+	} else {
+		var unmap func() error
+		if plaintext, unmap, err = readInput(inpath, opts.Mmap); err != nil {
+			return err
+		}
+		defer func() {
+			if unmapErr := unmap(); unmapErr != nil && err == nil {
+				err = fmt.Errorf("failed to unmap %s: %s", inpath, unmapErr)
+			}
+		}()
+	}
+
+	if !opts.Stdout && !opts.ToClipboard {
+		for _, path := range append([]string{outpath}, opts.AlsoOutputs...) {
+			if err = ensureOutputDir(path, opts.Mkdir); err != nil {
+				return err
+			}
+			if err = checkWritable(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	if opts.OnlyIfChanged {
+		unchanged, err := plaintextUnchanged(outpath, plaintext)
+		if err != nil {
+			return err
+		}
+		if unchanged {
+			_, err = fmt.Fprintf(os.Stderr, "%s is unchanged since last encrypted; skipping\n", source)
+			return err
+		}
+	}
+
+	if opts.Estimate {
+		if err = printEstimate(); err != nil {
+			return err
+		}
 	}
 
 	passphrase, err := preader.ReadPassphrase()
 	if err != nil {
 		return err
 	}
-	encryptedString, err := encryptBytes(passphrase, plaintext)
+	if opts.NoEmptyPassphrase && passphrase == "" {
+		return errors.New("refusing to encrypt with an empty passphrase, which provides essentially no protection")
+	}
+	encryptedString, err := encryptBytesWith(passphrase, plaintext, opts.ArmorEncoding)
 	if err != nil {
-		return fmt.Errorf("encryption failed: %s", err)
+		return &CommandError{Op: "encrypt", Path: source, Err: err}
 	}
 
-	err = ioutil.WriteFile(outpath, []byte(encryptedString), 0600)
-	if err != nil {
-		return fmt.Errorf("failed to write to %s: %s", outpath, err)
+	if opts.ToClipboard {
+		if err = clip.WriteAll([]byte(encryptedString)); err != nil {
+			return fmt.Errorf("failed to write to clipboard: %s", err)
+		}
+		return nil
+	}
+
+	if opts.Stdout {
+		// The PEM-like encoding already ends in a newline.
+		if _, err = fmt.Fprint(stdout, strings.TrimSuffix(encryptedString, "\n")+"\n"); err != nil {
+			return fmt.Errorf("failed to write to stdout: %s", err)
+		}
+		return nil
+	}
+
+	// All outputs, including signatures, are staged before any of them replaces its target, so that a failure
+	// (such as a full disk or a failed verification) leaves every existing file as it was.
+	outputs := &outputSet{}
+	defer outputs.discard()
+	for _, path := range append([]string{outpath}, opts.AlsoOutputs...) {
+		var tmpName string
+		if tmpName, err = outputs.stage(path, []byte(encryptedString)); err != nil {
+			return &CommandError{Op: "write to", Path: path, Err: err}
+		}
+		if opts.VerifyAfterWrite {
+			if err = verifyEncryptedFile(path, tmpName, passphrase, plaintext); err != nil {
+				return err
+			}
+		}
+		if signKey != nil {
+			if _, err = outputs.stage(sigPath(path), signature([]byte(encryptedString), signKey)); err != nil {
+				return &CommandError{Op: "write to", Path: sigPath(path), Err: err}
+			}
+		}
+	}
+	if err = outputs.commit(); err != nil {
+		return err
+	}
+
+	if opts.OnlyIfChanged {
+		if err = writeMeta(outpath, plaintext); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func decryptString(passphrase string, encryptedString string) ([]byte, error) {
-	cipherBytes, err := varmor.Unwrap(encryptedString)
+// outputSet writes a set of files together, each atomically (see writeFileAtomically). Each file is first staged
+// as a synced tempfile next to its target, and no target is replaced until commit is called, so that a failure
+// while staging leaves every target as it was.
+type outputSet struct {
+	staged []stagedOutput
+}
+
+type stagedOutput struct {
+	tmpName string
+	target  string
+	existed bool
+}
+
+// stage writes data to a tempfile which commit will rename to target, and returns the name of the tempfile.
+func (s *outputSet) stage(target string, data []byte) (string, error) {
+	_, statErr := fsys.Stat(target)
+	tmpName, err := stageFile(target, data)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unarmor: %s", err)
+		return "", err
 	}
+	s.staged = append(s.staged, stagedOutput{tmpName: tmpName, target: target, existed: !os.IsNotExist(statErr)})
 
-	plaintext, err := secretcrypt.Decrypt(passphrase, cipherBytes)
+	return tmpName, nil
+}
+
+// discard removes the tempfiles of all outputs staged but not yet committed. Targets are never touched.
+func (s *outputSet) discard() {
+	for _, output := range s.staged {
+		_ = fsys.Remove(output.tmpName)
+	}
+	s.staged = nil
+}
+
+// commit renames each staged file to its target, in the reverse order of staging so that the first output
+// staged (the primary output) is replaced last. Should a rename fail, the remaining tempfiles are removed, as are
+// targets already renamed into place which did not exist before. Existing files already replaced cannot be
+// restored, and are listed in the returned error.
+func (s *outputSet) commit() error {
+	for i := len(s.staged) - 1; i >= 0; i-- {
+		failed := s.staged[i]
+		err := fsys.Rename(failed.tmpName, failed.target)
+		if err == nil {
+			continue
+		}
+
+		err = fmt.Errorf("failed to write to %s: failed to rename to target file: %s", failed.target, err)
+		var replaced []string
+		for _, output := range s.staged[i+1:] {
+			if output.existed {
+				replaced = append(replaced, output.target)
+			} else if rmErr := fsys.Remove(output.target); rmErr != nil {
+				replaced = append(replaced, output.target)
+			}
+		}
+		s.staged = s.staged[:i+1]
+		if len(replaced) > 0 {
+			return fmt.Errorf("%s (already replaced: %s)", err, strings.Join(replaced, ", "))
+		}
+		return fmt.Errorf("%s (no outputs were changed)", err)
+	}
+	s.staged = nil
+
+	return nil
+}
+
+const (
+	metaMagic   = "saltybox-meta1"
+	metaSaltLen = 16
+)
+
+// metaPath returns the path of the sidecar file used by EncryptOptions.OnlyIfChanged for the given output.
+//
+// The sidecar holds a salted SHA-256 hash of the plain text. It does not reveal the plain text, but it does
+// reveal whether it changed between runs, and anyone holding it can test a guess of the complete plain text.
+func metaPath(outpath string) string {
+	return outpath + ".meta"
+}
+
+func hashPlaintext(salt []byte, plaintext []byte) []byte {
+	h := sha256.New()
+	_, _ = h.Write(salt)
+	_, _ = h.Write(plaintext)
+	return h.Sum(nil)
+}
+
+// plaintextUnchanged returns whether both outpath and its sidecar exist, and the sidecar matches plaintext.
+func plaintextUnchanged(outpath string, plaintext []byte) (bool, error) {
+	if _, err := fsys.Stat(outpath); err != nil {
+		return false, nil
+	}
+
+	metaBytes, err := fsys.ReadFile(metaPath(outpath))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to read from %s: %s", metaPath(outpath), err)
+	}
+
+	parts := strings.Split(strings.TrimSpace(string(metaBytes)), ":")
+	if len(parts) != 3 || parts[0] != metaMagic {
+		return false, fmt.Errorf("%s is not a valid saltybox sidecar file", metaPath(outpath))
+	}
+	salt, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false, fmt.Errorf("%s is not a valid saltybox sidecar file: %s", metaPath(outpath), err)
+	}
+	hash, err := hex.DecodeString(parts[2])
 	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt: %s", err)
+		return false, fmt.Errorf("%s is not a valid saltybox sidecar file: %s", metaPath(outpath), err)
 	}
 
-	return plaintext, nil
+	return hmac.Equal(hash, hashPlaintext(salt, plaintext)), nil
+}
+
+// writeMeta writes the sidecar of outpath to reflect plaintext.
+func writeMeta(outpath string, plaintext []byte) error {
+	salt := make([]byte, metaSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("rand.Read() should never fail, but did: %s", err)
+	}
+
+	meta := fmt.Sprintf("%s:%s:%s\n", metaMagic, hex.EncodeToString(salt), hex.EncodeToString(hashPlaintext(salt, plaintext)))
+	if err := fsys.WriteFile(metaPath(outpath), []byte(meta), 0600); err != nil {
+		return fmt.Errorf("failed to write to %s: %s", metaPath(outpath), err)
+	}
+
+	return nil
+}
+
+const sigMagic = "saltybox-sig1:hmac-sha256"
+
+// sigPath returns the path of the detached signature of the file at path (see EncryptOptions.SignKeyFile).
+func sigPath(path string) string {
+	return path + ".sig"
 }
 
-func Decrypt(inpath string, outpath string, preader preader.PassphraseReader) error {
-	varmoredBytes, err := ioutil.ReadFile(inpath)
+// readSignKey reads the signing key at keyPath.
+func readSignKey(keyPath string) ([]byte, error) {
+	key, err := fsys.ReadFile(keyPath)
 	if err != nil {
-		return fmt.Errorf("failed to read from %s: %s", inpath, err)
+		return nil, fmt.Errorf("failed to read signing key from %s: %s", keyPath, err)
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("signing key %s is empty", keyPath)
 	}
 
-	passphrase, err := preader.ReadPassphrase()
+	return key, nil
+}
+
+func sign(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// signature returns the detached signature of data, to be written to the sidecar (see sigPath) of the file
+// containing data.
+func signature(data []byte, key []byte) []byte {
+	return []byte(fmt.Sprintf("%s:%s\n", sigMagic, hex.EncodeToString(sign(key, data))))
+}
+
+// VerifySignature checks the detached signature at sigpath (see EncryptOptions.SignKeyFile) of the file at
+// inpath using the signing key at keyPath. No passphrase is required since nothing is decrypted. If sigpath is
+// empty, the sidecar of inpath is used.
+func VerifySignature(inpath string, sigpath string, keyPath string) error {
+	if sigpath == "" {
+		sigpath = sigPath(inpath)
+	}
+
+	key, err := readSignKey(keyPath)
 	if err != nil {
 		return err
 	}
-	plaintext, err := decryptString(passphrase, string(varmoredBytes))
+
+	data, err := fsys.ReadFile(inpath)
 	if err != nil {
-		return fmt.Errorf("failed to decrypt: %s", err)
+		return fmt.Errorf("failed to read from %s: %s", inpath, err)
 	}
 
-	err = ioutil.WriteFile(outpath, plaintext, 0600)
+	sigBytes, err := fsys.ReadFile(sigpath)
 	if err != nil {
-		return fmt.Errorf("failed to write to %s: %s", outpath, err)
+		return fmt.Errorf("failed to read from %s: %s", sigpath, err)
+	}
+
+	sig := strings.TrimSpace(string(sigBytes))
+	if !strings.HasPrefix(sig, sigMagic+":") {
+		return fmt.Errorf("%s is not a valid saltybox signature file", sigpath)
+	}
+	mac, err := hex.DecodeString(strings.TrimPrefix(sig, sigMagic+":"))
+	if err != nil {
+		return fmt.Errorf("%s is not a valid saltybox signature file: %s", sigpath, err)
+	}
+
+	if !hmac.Equal(mac, sign(key, data)) {
+		return fmt.Errorf("signature verification failed: %s has been modified or the signing key is wrong", inpath)
 	}
 
 	return nil
 }
 
-func Update(plainfile string, cryptfile string, pr preader.PassphraseReader) (err error) {
-	// Decrypt existing file in order to validate that the provided passphrase is correct,
-	// in order to prevent accidental changing of the passphrase (but we discard the plain
-	// text).
-	varmoredBytes, err := ioutil.ReadFile(cryptfile)
+// verifyEncryptedFile checks that the file written for path, at writtenPath (such as a tempfile staged for it),
+// decrypts to plaintext using passphrase.
+func verifyEncryptedFile(path string, writtenPath string, passphrase string, plaintext []byte) error {
+	writtenBytes, err := fsys.ReadFile(writtenPath)
 	if err != nil {
-		return fmt.Errorf("failed to read from %s: %s", cryptfile, err)
+		return fmt.Errorf("verification failed: failed to read back %s: %s", path, err)
+	}
+
+	decrypted, err := decryptString(passphrase, string(writtenBytes))
+	if err != nil {
+		return fmt.Errorf("verification failed: %s does not decrypt: %s", path, err)
+	}
+
+	if !bytes.Equal(decrypted, plaintext) {
+		return fmt.Errorf("verification failed: %s does not decrypt to the original plain text", path)
 	}
 
-	cachingPreader := preader.NewCaching(pr)
+	return nil
+}
 
-	passphrase, err := cachingPreader.ReadPassphrase()
+func decryptString(passphrase string, encryptedString string) ([]byte, error) {
+	cipherBytes, err := varmor.Unwrap(encryptedString)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to unarmor: %w", err)
 	}
-	_, err = decryptString(passphrase, string(varmoredBytes))
+
+	plaintext, err := secretcrypt.Decrypt(passphrase, cipherBytes)
 	if err != nil {
-		return fmt.Errorf("failed to decrypt: %s", err)
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
 	}
 
-	// Encrypt contents into the target file using atomic semantics (write to tempfile, fsync()
-	// and rename). This guarantees that the resulting file will either be the old file or the new
-	// file, but never corrupt (assuming a correctly functioning filesystem I/O stack).
-	cryptDir, _ := path.Split(cryptfile)
+	return plaintext, nil
+}
+
+// DecryptStrings decrypts multiple armored strings using the same passphrase.
+//
+// This is the armored counterpart of secretcrypt.DecryptBatch; the returned slices are parallel to armored.
+func DecryptStrings(passphrase string, armored []string) ([][]byte, []error) {
+	plaintexts := make([][]byte, len(armored))
+	errs := make([]error, len(armored))
 
-	tmpfile, err := ioutil.TempFile(cryptDir, "saltybox-update-tmp")
-	if err != nil {
-		return fmt.Errorf("failed to create tempfile: %s", err)
+	var blobs [][]byte
+	var blobIndexes []int
+	for i, s := range armored {
+		cipherBytes, err := varmor.Unwrap(s)
+		if err != nil {
+			errs[i] = fmt.Errorf("failed to unarmor: %s", err)
+			continue
+		}
+		blobs = append(blobs, cipherBytes)
+		blobIndexes = append(blobIndexes, i)
 	}
-	defer func(fname string) {
-		if _, localErr := os.Stat(fname); !os.IsNotExist(localErr) {
-			err = os.Remove(fname)
+
+	blobPlaintexts, blobErrs := secretcrypt.DecryptBatch(passphrase, blobs)
+	for j, i := range blobIndexes {
+		plaintexts[i] = blobPlaintexts[j]
+		if blobErrs[j] != nil {
+			errs[i] = fmt.Errorf("failed to decrypt: %s", blobErrs[j])
 		}
-	}(tmpfile.Name())
-	defer func(tmpfile *os.File) {
-		err = tmpfile.Close()
-	}(tmpfile)
+	}
 
-	err = Encrypt(plainfile, tmpfile.Name(), cachingPreader)
-	if err != nil {
-		return fmt.Errorf("failed to encrypt: %s", err)
+	return plaintexts, errs
+}
+
+func Decrypt(inpath string, outpath string, preader preader.PassphraseReader, opts DecryptOptions) error {
+	if err := checkPaths(inpath, outpath); err != nil {
+		return err
+	}
+
+	if opts.MaxAge != "" {
+		if err := checkAge(inpath, opts.MaxAge); err != nil {
+			return err
+		}
 	}
 
-	// Re-open the file to ensure that we are Sync():ing the correct file. Technically this is not
-	// required because passphraseEncryptFile() will cause the target file to be truncated rather than recreated.
-	// However, let's defensively avoid relying on that subtle behavior and re-open the file.
-	reopenedTmpFile, err := os.Open(tmpfile.Name())
+	var varmoredBytes []byte
+	var err error
+	if isURL(inpath) {
+		varmoredBytes, err = fetchURL(inpath, opts.HTTPHeaders, opts.CAFile)
+	} else {
+		varmoredBytes, err = fsys.ReadFile(inpath)
+		if err != nil {
+			err = &CommandError{Op: "read from", Path: inpath, Err: err}
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("failed to re-open tempfile after encryption: %s", err)
+		return err
+	}
+
+	if _, ok := formatCheckers[opts.ExpectFormat]; opts.ExpectFormat != "" && !ok {
+		return fmt.Errorf("unsupported format %q; supported formats are json and yaml", opts.ExpectFormat)
+	}
+	if opts.Strict && opts.NoArmor {
+		return errors.New("strict armor checking cannot be combined with raw input")
+	}
+	if opts.Strict {
+		if _, err = varmor.UnwrapStrict(string(varmoredBytes)); err != nil {
+			return &CommandError{Op: "unarmor", Path: inpath, Err: err}
+		}
+	}
+
+	var secureDir string
+	if opts.SecureTmp {
+		if secureDir, err = secureTmpDir(); err != nil {
+			return fmt.Errorf("refusing to write output to persistent storage: %s", err)
+		}
+	} else {
+		if err = ensureOutputDir(outpath, opts.Mkdir); err != nil {
+			return err
+		}
+		if err = checkWritable(outpath); err != nil {
+			return err
+		}
+	}
+
+	if opts.Estimate {
+		if err = printEstimate(); err != nil {
+			return err
+		}
 	}
-	defer func(f *os.File) {
-		err = f.Close()
-	}(reopenedTmpFile)
 
-	err = reopenedTmpFile.Sync()
+	passphrase, err := preader.ReadPassphrase()
 	if err != nil {
-		return fmt.Errorf("failed to sync file prior to rename: %s", err)
+		return err
+	}
+	decrypt := func(passphrase string) ([]byte, error) {
+		cipherBytes := varmoredBytes
+		if !opts.NoArmor {
+			var unwrapErr error
+			if cipherBytes, unwrapErr = varmor.Unwrap(string(varmoredBytes)); unwrapErr != nil {
+				return nil, fmt.Errorf("failed to unarmor: %w", unwrapErr)
+			}
+		}
+		return secretcrypt.Decrypt(passphrase, cipherBytes)
+	}
+	plaintext, decryptErr := decrypt(passphrase)
+	// Only a wrong passphrase can be fixed by trying variants of it. If none work, the original error is reported.
+	if decryptErr != nil && opts.TryNewlineVariants && errors.Is(decryptErr, secretcrypt.ErrAuthentication) {
+		for _, variant := range newlineVariants(passphrase) {
+			if variantPlaintext, variantErr := decrypt(variant.passphrase); variantErr == nil {
+				_, err = fmt.Fprintf(os.Stderr, "Decrypted using the passphrase %s; consider re-encrypting with the intended passphrase\n",
+					variant.description)
+				if err != nil {
+					return err
+				}
+				plaintext, decryptErr = variantPlaintext, nil
+				break
+			}
+		}
+	}
+	if decryptErr != nil {
+		return &CommandError{Op: "decrypt", Path: inpath, Err: decryptErr}
 	}
 
-	err = os.Rename(reopenedTmpFile.Name(), cryptfile)
+	if opts.ExpectFormat != "" {
+		if err = formatCheckers[opts.ExpectFormat](plaintext); err != nil {
+			return fmt.Errorf("refusing to write output: plain text is not valid %s: %s", opts.ExpectFormat, err)
+		}
+	}
+
+	if opts.SecureTmp {
+		if outpath, err = writeSecureTmp(secureDir, filepath.Base(outpath), plaintext); err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(os.Stderr, "Wrote plain text to %s\n", outpath)
+		return err
+	}
+
+	// Written atomically so that a failure (such as a full disk) never leaves a truncated plain text at outpath
+	// which might be mistaken for the real thing.
+	err = writeFileAtomically(outpath, plaintext)
 	if err != nil {
-		return fmt.Errorf("failed to rename to target file: %s", err)
+		return &CommandError{Op: "write to", Path: outpath, Err: err}
 	}
 
 	return nil
 }
+
+type passphraseVariant struct {
+	passphrase  string
+	description string
+}
+
+// newlineVariants returns variants of passphrase which may have been used by accident, such as when a
+// passphrase was piped in along with a trailing newline.
+func newlineVariants(passphrase string) []passphraseVariant {
+	variants := []passphraseVariant{
+		{passphrase + "\n", "with a trailing newline (\\n) added"},
+		{passphrase + "\r\n", "with a trailing CRLF (\\r\\n) added"},
+	}
+	if trimmed := strings.TrimRight(passphrase, " \t\r\n"); trimmed != passphrase {
+		variants = append(variants, passphraseVariant{trimmed, "with trailing whitespace removed"})
+	}
+
+	return variants
+}
+
+// formatCheckers return an error unless the content parses as the format they are keyed by (see
+// DecryptOptions.ExpectFormat). Note that almost any text is valid YAML (as a plain scalar), so the YAML check
+// mostly catches binary data and syntax errors.
+var formatCheckers = map[string]func(content []byte) error{
+	"json": func(content []byte) error {
+		var v interface{}
+		return json.Unmarshal(content, &v)
+	},
+	"yaml": func(content []byte) error {
+		if !utf8.Valid(content) {
+			return errors.New("not valid UTF-8")
+		}
+		var v interface{}
+		return yaml.Unmarshal(content, &v)
+	},
+}
+
+const (
+	fetchTimeout = 30 * time.Second
+
+	// Upper bound on the size of input fetched over HTTP(S), to avoid exhausting memory.
+	maxFetchLen = 64 * 1024 * 1024
+)
+
+func isURL(inpath string) bool {
+	return strings.HasPrefix(inpath, "http://") || strings.HasPrefix(inpath, "https://")
+}
+
+// fetchURL fetches the body of url into memory. Errors are prefixed to make it clear that they happened while
+// fetching rather than while decrypting.
+func fetchURL(url string, headers []string, caFile string) ([]byte, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile != "" {
+		pemBytes, err := fsys.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch %s: failed to read CA file %s: %s", url, caFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemBytes) {
+			return nil, fmt.Errorf("failed to fetch %s: no certificates found in CA file %s", url, caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	client := &http.Client{Timeout: fetchTimeout, Transport: transport}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %s", url, err)
+	}
+	for _, header := range headers {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid header %q; expected \"Name: value\"", header)
+		}
+		req.Header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %s", url, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: server responded with %s", url, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxFetchLen+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %s", url, err)
+	}
+	if len(body) > maxFetchLen {
+		return nil, fmt.Errorf("failed to fetch %s: response larger than %d bytes", url, maxFetchLen)
+	}
+
+	return body, nil
+}
+
+// writeSecureTmp writes data to a file named base in a new private (0700) directory within dir, returning the
+// path written to. Since dir may be world-writable (such as /dev/shm), the file is never written at a predictable
+// path: another local user could otherwise pre-create it or plant a symlink there. The file is also created
+// exclusively and without following symlinks.
+func writeSecureTmp(dir string, base string, data []byte) (outpath string, err error) {
+	privateDir, err := fsys.TempDir(dir, "saltybox-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create private directory: %s", err)
+	}
+	outpath = filepath.Join(privateDir, base)
+	defer func() {
+		if err != nil {
+			_ = fsys.Remove(outpath)
+			_ = fsys.Remove(privateDir)
+		}
+	}()
+
+	f, err := fsys.CreateExclusive(outpath, 0600)
+	if err != nil {
+		return "", &CommandError{Op: "write to", Path: outpath, Err: err}
+	}
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		return "", &CommandError{Op: "write to", Path: outpath, Err: err}
+	}
+	if err = f.Close(); err != nil {
+		return "", &CommandError{Op: "write to", Path: outpath, Err: err}
+	}
+
+	return outpath, nil
+}
+
+// UpdateOptions controls optional behavior of Update.
+type UpdateOptions struct {
+	// Retries is the number of additional times the passphrase is read if it fails to decrypt the existing
+	// file, such as to allow an interactive user to correct a typo. Only the validation of the existing file is
+	// retried. Should only be used with a PassphraseReader which yields a new passphrase on each read.
+	Retries int
+
+	// DryRun causes the existing file to be decrypted (validating the passphrase) and a summary of the update,
+	// including whether the plain text would change and the resulting size, to be written to stdout, without
+	// writing anything to disk.
+	DryRun bool
+}
+
+// Update re-encrypts the contents of plainfile into the existing saltybox file cryptfile, using the same
+// passphrase (which is validated by decrypting cryptfile first). Fails if cryptfile does not exist or is not a
+// saltybox file; use Encrypt to create a new file.
+func Update(plainfile string, cryptfile string, pr preader.PassphraseReader, opts UpdateOptions) error {
+	if _, err := fsys.Stat(cryptfile); os.IsNotExist(err) {
+		return fmt.Errorf("target file %s does not exist; use encrypt to create it", cryptfile)
+	}
+
+	// Decrypt existing file in order to validate that the provided passphrase is correct,
+	// in order to prevent accidental changing of the passphrase (but we discard the plain
+	// text).
+	varmoredBytes, err := fsys.ReadFile(cryptfile)
+	if err != nil {
+		return &CommandError{Op: "read from", Path: cryptfile, Err: err}
+	}
+	encoding, ok := varmor.EncodingOf(string(varmoredBytes))
+	if !ok {
+		return fmt.Errorf("target %s is not a saltybox file", cryptfile)
+	}
+	if !opts.DryRun {
+		if err = checkWritable(cryptfile); err != nil {
+			return err
+		}
+	}
+	cipherBytes, err := varmor.Unwrap(string(varmoredBytes))
+	if err != nil {
+		return &CommandError{Op: "unarmor", Path: cryptfile, Err: err}
+	}
+
+	var passphrase string
+	var oldPlaintext []byte
+	for attempt := 0; ; attempt++ {
+		passphrase, err = pr.ReadPassphrase()
+		if err != nil {
+			return err
+		}
+		oldPlaintext, err = secretcrypt.Decrypt(passphrase, cipherBytes)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, secretcrypt.ErrAuthentication) || attempt >= opts.Retries {
+			return &CommandError{Op: "decrypt", Path: cryptfile, Err: err}
+		}
+
+		_, err = fmt.Fprintln(os.Stderr, "Passphrase does not unlock the existing file; try again.")
+		if err != nil {
+			return err
+		}
+	}
+
+	plaintext, err := fsys.ReadFile(plainfile)
+	if err != nil {
+		return &CommandError{Op: "read from", Path: plainfile, Err: err}
+	}
+
+	if opts.DryRun {
+		changed := "no"
+		if !bytes.Equal(oldPlaintext, plaintext) {
+			changed = "yes"
+		}
+		// The size is computed rather than encrypting, which would cost a second key derivation.
+		size, err := varmor.WrappedLenWith(encoding, int(secretcrypt.CiphertextLen(int64(len(plaintext)))))
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(stdout, "passphrase: ok\nplain text changed: %s\nsize: %d bytes (currently %d bytes)\n",
+			changed, size, len(varmoredBytes))
+		if err != nil {
+			return fmt.Errorf("failed to write to stdout: %s", err)
+		}
+		return nil
+	}
+
+	// The file keeps its armor encoding.
+	encryptedString, err := encryptBytesWith(passphrase, plaintext, encoding)
+	if err != nil {
+		return &CommandError{Op: "encrypt", Path: plainfile, Err: err}
+	}
+
+	if err = writeFileAtomically(cryptfile, []byte(encryptedString)); err != nil {
+		return &CommandError{Op: "write to", Path: cryptfile, Err: err}
+	}
+
+	return nil
+}
+
+// maxRepairJunk is the maximum number of trailing junk bytes Repair will remove. More than this suggests
+// corruption rather than an artifact of transfer (such as an appended newline or padding with NUL bytes).
+const maxRepairJunk = 16
+
+// Repair removes trailing junk, such as whitespace or NUL bytes appended by transfer tools, from the saltybox
+// file at path. Junk is removed both from the armored text and, if the armor decodes to more than the sealed box
+// claims, from the decoded bytes. The result must decrypt with the passphrase read from pr, after which it is
+// re-armored in the same encoding and written back atomically. Repair is refused if there is more than
+// maxRepairJunk bytes of junk. A description of what was done is written to w.
+func Repair(path string, pr preader.PassphraseReader, w io.Writer) error {
+	varmoredBytes, err := fsys.ReadFile(path)
+	if err != nil {
+		return &CommandError{Op: "read from", Path: path, Err: err}
+	}
+	original := string(varmoredBytes)
+
+	encoding, ok := varmor.EncodingOf(original)
+	if !ok {
+		return fmt.Errorf("%s is not a saltybox file", path)
+	}
+
+	trimmed := strings.TrimRight(original, " \t\r\n\x00")
+	junk := len(original) - len(trimmed)
+
+	cipherBytes, err := varmor.Unwrap(trimmed)
+	if err != nil {
+		return fmt.Errorf("cannot repair %s: failed to unarmor: %s", path, err)
+	}
+	header, err := secretcrypt.Inspect(cipherBytes)
+	if err != nil {
+		return fmt.Errorf("cannot repair %s: %s", path, err)
+	}
+	validLen := secretcrypt.HeaderLen + int(header.SealedBoxLen)
+	junk += len(cipherBytes) - validLen
+	cipherBytes = cipherBytes[:validLen]
+
+	if junk > maxRepairJunk {
+		return fmt.Errorf("refusing to repair %s: %d bytes of trailing junk is more than the %d expected from transfer artifacts; the file is likely corrupt",
+			path, junk, maxRepairJunk)
+	}
+
+	repaired, err := varmor.WrapWith(encoding, cipherBytes)
+	if err != nil {
+		return err
+	}
+	if repaired == original {
+		_, err = fmt.Fprintf(w, "%s has no trailing junk; nothing to repair\n", path)
+		return err
+	}
+
+	passphrase, err := pr.ReadPassphrase()
+	if err != nil {
+		return err
+	}
+	if _, err = secretcrypt.Decrypt(passphrase, cipherBytes); err != nil {
+		return fmt.Errorf("cannot repair %s: does not decrypt after removing trailing junk: %s", path, err)
+	}
+
+	if err = writeFileAtomically(path, []byte(repaired)); err != nil {
+		return &CommandError{Op: "write to", Path: path, Err: err}
+	}
+
+	_, err = fmt.Fprintf(w, "Removed %d bytes of trailing junk from %s\n", junk, path)
+	return err
+}
+
+// Recover attempts to find the passphrase of the saltybox file at inpath by trying each line of the file at
+// wordlistPath as a candidate passphrase.
+//
+// This is a recovery aid for files owned by the user whose exact passphrase has been forgotten, but where a
+// small set of likely candidates is known. Candidates are tried concurrently by parallelism workers since
+// key derivation is expensive. Progress is reported to progress, and the search stops at the first candidate
+// that successfully decrypts the file.
+//
+// If no candidate succeeds, found is false and err is nil.
+func Recover(inpath string, wordlistPath string, parallelism int, progress io.Writer) (passphrase string, found bool, err error) {
+	if parallelism < 1 {
+		return "", false, fmt.Errorf("parallelism must be at least 1, was %d", parallelism)
+	}
+
+	varmoredBytes, err := fsys.ReadFile(inpath)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read from %s: %s", inpath, err)
+	}
+
+	cipherBytes, err := varmor.Unwrap(string(varmoredBytes))
+	if err != nil {
+		return "", false, fmt.Errorf("failed to unarmor: %s", err)
+	}
+
+	wordlistBytes, err := fsys.ReadFile(wordlistPath)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read from %s: %s", wordlistPath, err)
+	}
+
+	candidates := strings.Split(string(wordlistBytes), "\n")
+	if len(candidates) > 0 && candidates[len(candidates)-1] == "" {
+		candidates = candidates[:len(candidates)-1]
+	}
+
+	candidateChan := make(chan string)
+	done := make(chan struct{})
+	var doneOnce sync.Once
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var progressErr error
+	tried := 0
+
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for candidate := range candidateChan {
+				_, decryptErr := secretcrypt.Decrypt(candidate, cipherBytes)
+
+				mu.Lock()
+				tried++
+				if _, err := fmt.Fprintf(progress, "Tried %d/%d candidates\n", tried, len(candidates)); err != nil && progressErr == nil {
+					progressErr = err
+				}
+				if decryptErr == nil && !found {
+					passphrase = candidate
+					found = true
+					doneOnce.Do(func() { close(done) })
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, candidate := range candidates {
+		select {
+		case candidateChan <- strings.TrimSuffix(candidate, "\r"):
+		case <-done:
+			break feed
+		}
+	}
+	close(candidateChan)
+	wg.Wait()
+
+	if progressErr != nil {
+		return "", false, fmt.Errorf("failed to report progress: %s", progressErr)
+	}
+
+	return passphrase, found, nil
+}
+
+// walkSaltyboxFiles calls fn, in lexical order, for each saltybox file in the directory tree rooted at dir, with
+// the file's path and contents. Other files, and anything which is not a regular file or directory, are skipped.
+func walkSaltyboxFiles(dir string, fn func(path string, varmored string) error) error {
+	infos, err := fsys.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %s", dir, err)
+	}
+
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		if info.IsDir() {
+			if err = walkSaltyboxFiles(path, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		data, err := fsys.ReadFile(path)
+		if err != nil {
+			return &CommandError{Op: "read from", Path: path, Err: err}
+		}
+		if varmor.IsSaltybox(string(data)) {
+			if err = fn(path, string(data)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// VerifyDir checks that every saltybox file in the directory tree rooted at dir decrypts with the passphrase
+// read (once) from pr, writing the result for each file and a summary to w. Other files are skipped. Files are
+// checked concurrently by parallelism workers since key derivation is expensive. An error is returned if any
+// file fails to decrypt, or if there are no saltybox files at all.
+func VerifyDir(dir string, pr preader.PassphraseReader, parallelism int, w io.Writer) error {
+	if parallelism < 1 {
+		return fmt.Errorf("parallelism must be at least 1, was %d", parallelism)
+	}
+
+	type check struct {
+		path     string
+		varmored string
+		err      error
+	}
+	var checks []*check
+	err := walkSaltyboxFiles(dir, func(path string, varmored string) error {
+		checks = append(checks, &check{path: path, varmored: varmored})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(checks) == 0 {
+		return fmt.Errorf("no saltybox files found in %s", dir)
+	}
+
+	passphrase, err := pr.ReadPassphrase()
+	if err != nil {
+		return err
+	}
+
+	checkChan := make(chan *check)
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range checkChan {
+				_, c.err = decryptString(passphrase, c.varmored)
+			}
+		}()
+	}
+	for _, c := range checks {
+		checkChan <- c
+	}
+	close(checkChan)
+	wg.Wait()
+
+	failed := 0
+	for _, c := range checks {
+		line := fmt.Sprintf("ok: %s", c.path)
+		if c.err != nil {
+			failed++
+			line = fmt.Sprintf("FAILED: %s: %s", c.path, c.err)
+		}
+		if _, err = fmt.Fprintln(w, line); err != nil {
+			return fmt.Errorf("failed to write output: %s", err)
+		}
+	}
+	if _, err = fmt.Fprintf(w, "%d passed, %d failed\n", len(checks)-failed, failed); err != nil {
+		return fmt.Errorf("failed to write output: %s", err)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed to decrypt", failed, len(checks))
+	}
+
+	return nil
+}
+
+// AuditPerms reports, to w, each saltybox file in the directory tree rooted at dir which is readable or writable
+// by group or others. If fix is true, such files are changed to mode 0600. An error is returned if any such file
+// remains.
+func AuditPerms(dir string, fix bool, w io.Writer) error {
+	violations := 0
+	err := walkSaltyboxFiles(dir, func(path string, varmored string) error {
+		info, err := fsys.Stat(path)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %s", path, err)
+		}
+		if info.Mode().Perm()&0077 == 0 {
+			return nil
+		}
+
+		line := fmt.Sprintf("%s: %s is accessible by group or others", path, info.Mode().Perm())
+		if fix {
+			if err = fsys.Chmod(path, 0600); err != nil {
+				return fmt.Errorf("failed to change permissions of %s: %s", path, err)
+			}
+			line += fmt.Sprintf("; changed to %s", os.FileMode(0600))
+		} else {
+			violations++
+		}
+
+		if _, err = fmt.Fprintln(w, line); err != nil {
+			return fmt.Errorf("failed to write output: %s", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if violations > 0 {
+		return fmt.Errorf("%d saltybox files are accessible by group or others (use --fix to change them to 0600)", violations)
+	}
+
+	return nil
+}
+
+// StegoEmbed encrypts the contents of inpath and embeds the armored result in the PNG image at coverPath,
+// writing the resulting PNG image to outpath.
+func StegoEmbed(inpath string, coverPath string, outpath string, pr preader.PassphraseReader) error {
+	plaintext, err := fsys.ReadFile(inpath)
+	if err != nil {
+		return fmt.Errorf("failed to read from %s: %s", inpath, err)
+	}
+
+	coverBytes, err := fsys.ReadFile(coverPath)
+	if err != nil {
+		return fmt.Errorf("failed to read from %s: %s", coverPath, err)
+	}
+
+	cover, err := png.Decode(bytes.NewReader(coverBytes))
+	if err != nil {
+		return fmt.Errorf("failed to decode PNG image %s: %s", coverPath, err)
+	}
+
+	passphrase, err := pr.ReadPassphrase()
+	if err != nil {
+		return err
+	}
+	encryptedString, err := encryptBytes(passphrase, plaintext)
+	if err != nil {
+		return fmt.Errorf("encryption failed: %s", err)
+	}
+
+	img, err := stego.Embed(cover, []byte(encryptedString))
+	if err != nil {
+		return fmt.Errorf("failed to embed: %s", err)
+	}
+
+	var imgBuf bytes.Buffer
+	err = png.Encode(&imgBuf, img)
+	if err != nil {
+		return fmt.Errorf("failed to encode PNG image: %s", err)
+	}
+
+	err = fsys.WriteFile(outpath, imgBuf.Bytes(), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write to %s: %s", outpath, err)
+	}
+
+	return nil
+}
+
+// StegoExtract extracts data previously embedded by StegoEmbed from the PNG image at inpath, decrypts it
+// and writes the plain text to outpath.
+func StegoExtract(inpath string, outpath string, pr preader.PassphraseReader) error {
+	imgBytes, err := fsys.ReadFile(inpath)
+	if err != nil {
+		return fmt.Errorf("failed to read from %s: %s", inpath, err)
+	}
+
+	img, err := png.Decode(bytes.NewReader(imgBytes))
+	if err != nil {
+		return fmt.Errorf("failed to decode PNG image %s: %s", inpath, err)
+	}
+
+	varmoredBytes, err := stego.Extract(img)
+	if err != nil {
+		return fmt.Errorf("failed to extract: %s", err)
+	}
+
+	passphrase, err := pr.ReadPassphrase()
+	if err != nil {
+		return err
+	}
+	plaintext, err := decryptString(passphrase, string(varmoredBytes))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt: %s", err)
+	}
+
+	err = fsys.WriteFile(outpath, plaintext, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write to %s: %s", outpath, err)
+	}
+
+	return nil
+}
+
+// writeFileAtomically replaces the contents of target with data using atomic semantics (write to tempfile,
+// fsync() and rename). The resulting file will either be the old file or the new file, but never corrupt
+// (assuming a correctly functioning filesystem I/O stack).
+func writeFileAtomically(target string, data []byte) error {
+	tmpName, err := stageFile(target, data)
+	if err != nil {
+		return err
+	}
+
+	if err = fsys.Rename(tmpName, target); err != nil {
+		_ = fsys.Remove(tmpName)
+		return fmt.Errorf("failed to rename to target file: %s", err)
+	}
+
+	return nil
+}
+
+// stageFile writes data to a synced tempfile in the directory of target, ready to be renamed over it, and returns
+// the name of the tempfile. The tempfile is removed on failure.
+func stageFile(target string, data []byte) (tmpName string, err error) {
+	dir, _ := path.Split(target)
+	if dir == "" {
+		// Not the empty string, which would mean the system tempdir and may be on another filesystem.
+		dir = "."
+	}
+
+	tmpfile, err := fsys.TempFile(dir, "saltybox-tmp")
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to create tempfile: directory does not exist: %s", filepath.Dir(target))
+	} else if err != nil {
+		return "", fmt.Errorf("failed to create tempfile: %s", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = fsys.Remove(tmpfile.Name())
+		}
+	}()
+
+	_, err = tmpfile.Write(data)
+	if err != nil {
+		_ = tmpfile.Close()
+		return "", fmt.Errorf("failed to write to tempfile: %s", err)
+	}
+
+	err = tmpfile.Sync()
+	if err != nil {
+		_ = tmpfile.Close()
+		return "", fmt.Errorf("failed to sync file prior to rename: %s", err)
+	}
+
+	err = tmpfile.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to close tempfile: %s", err)
+	}
+
+	return tmpfile.Name(), nil
+}
+
+// Rekey changes the secret protecting the saltybox file at cryptfile by decrypting it with the passphrase from
+// oldPr and re-encrypting it with the passphrase from newPr. The file is replaced atomically.
+//
+// Either reader may be a keyfile reader (see preader.NewFile), in which case the contents of the keyfile is
+// used as the secret. This allows moving files between passphrase based and keyfile based access.
+func Rekey(cryptfile string, oldPr preader.PassphraseReader, newPr preader.PassphraseReader) error {
+	varmoredBytes, err := fsys.ReadFile(cryptfile)
+	if err != nil {
+		return fmt.Errorf("failed to read from %s: %s", cryptfile, err)
+	}
+
+	oldPassphrase, err := oldPr.ReadPassphrase()
+	if err != nil {
+		return err
+	}
+	plaintext, err := decryptString(oldPassphrase, string(varmoredBytes))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt: %s", err)
+	}
+
+	newPassphrase, err := newPr.ReadPassphrase()
+	if err != nil {
+		return err
+	}
+	// The file keeps its armor encoding.
+	encoding, _ := varmor.EncodingOf(string(varmoredBytes))
+	encryptedString, err := encryptBytesWith(newPassphrase, plaintext, encoding)
+	if err != nil {
+		return fmt.Errorf("encryption failed: %s", err)
+	}
+
+	return writeFileAtomically(cryptfile, []byte(encryptedString))
+}
+
+// GenKeyfile writes a new keyfile consisting of n random bytes to outpath, with permissions restricting access
+// to the owner. The keyfile can then be used as the secret for encryption (see preader.NewFile).
+//
+// An existing file at outpath is only overwritten if force is true, since doing so may destroy the only copy
+// of a key.
+func GenKeyfile(outpath string, n int, force bool) error {
+	if n <= 0 {
+		return fmt.Errorf("keyfile size must be positive, was %d", n)
+	}
+
+	if !force {
+		if _, err := fsys.Stat(outpath); err == nil {
+			return fmt.Errorf("%s already exists; refusing to overwrite a keyfile without --force", outpath)
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to stat %s: %s", outpath, err)
+		}
+	}
+
+	key := make([]byte, n)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("rand.Read() should never fail, but did: %s", err)
+	}
+
+	if err := fsys.WriteFile(outpath, key, 0600); err != nil {
+		return fmt.Errorf("failed to write to %s: %s", outpath, err)
+	}
+
+	return nil
+}
+
+var (
+	// ErrDualOuterLayer is wrapped by errors from DecryptDual caused by failing to decrypt the outer layer, which
+	// is protected by the second passphrase.
+	ErrDualOuterLayer = errors.New("failed to decrypt outer layer (second passphrase)")
+
+	// ErrDualInnerLayer is wrapped by errors from DecryptDual caused by failing to decrypt the inner layer, which
+	// is protected by the first passphrase.
+	ErrDualInnerLayer = errors.New("failed to decrypt inner layer (first passphrase)")
+)
+
+// EncryptDual encrypts plaintext such that both passphrases are required to decrypt it, returning the armored
+// result. The plaintext is encrypted with pass1, and the result encrypted again with pass2.
+//
+// The passphrases must differ, since using the same one twice defeats the purpose.
+func EncryptDual(pass1 string, pass2 string, plaintext []byte) (string, error) {
+	if pass1 == pass2 {
+		return "", errors.New("the two passphrases must differ")
+	}
+
+	inner, err := secretcrypt.Encrypt(pass1, plaintext)
+	if err != nil {
+		return "", fmt.Errorf("encryption of inner layer failed: %s", err)
+	}
+
+	return encryptBytes(pass2, inner)
+}
+
+// DecryptDual decrypts an armored string produced by EncryptDual. The returned error wraps ErrDualOuterLayer or
+// ErrDualInnerLayer (see errors.Is) depending on which layer failed to decrypt.
+func DecryptDual(pass1 string, pass2 string, armored string) ([]byte, error) {
+	inner, err := decryptString(pass2, armored)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrDualOuterLayer, err)
+	}
+
+	plaintext, err := secretcrypt.Decrypt(pass1, inner)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrDualInnerLayer, err)
+	}
+
+	return plaintext, nil
+}
+
+// EncryptDualFile is like Encrypt, except that the output requires both the passphrase from pr1 and that from
+// pr2 to decrypt (see EncryptDual). Encryption is refused if the two passphrases are the same, since that most
+// likely means both were read from a single source.
+func EncryptDualFile(inpath string, outpath string, pr1 preader.PassphraseReader, pr2 preader.PassphraseReader) error {
+	if err := checkPaths(inpath, outpath); err != nil {
+		return err
+	}
+
+	plaintext, err := fsys.ReadFile(inpath)
+	if err != nil {
+		return fmt.Errorf("failed to read from %s: %s", inpath, err)
+	}
+
+	pass1, err := pr1.ReadPassphrase()
+	if err != nil {
+		return err
+	}
+	pass2, err := pr2.ReadPassphrase()
+	if err != nil {
+		return err
+	}
+	if pass1 == pass2 {
+		return errors.New("the two passphrases are the same; refusing to encrypt, since a single passphrase would then suffice to decrypt")
+	}
+
+	encryptedString, err := EncryptDual(pass1, pass2, plaintext)
+	if err != nil {
+		return fmt.Errorf("encryption failed: %s", err)
+	}
+
+	err = fsys.WriteFile(outpath, []byte(encryptedString), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write to %s: %s", outpath, err)
+	}
+
+	return nil
+}
+
+// DecryptDualFile decrypts a file produced by EncryptDualFile, using the same two passphrases in the same order.
+func DecryptDualFile(inpath string, outpath string, pr1 preader.PassphraseReader, pr2 preader.PassphraseReader) error {
+	if err := checkPaths(inpath, outpath); err != nil {
+		return err
+	}
+
+	varmoredBytes, err := fsys.ReadFile(inpath)
+	if err != nil {
+		return fmt.Errorf("failed to read from %s: %s", inpath, err)
+	}
+
+	pass1, err := pr1.ReadPassphrase()
+	if err != nil {
+		return err
+	}
+	pass2, err := pr2.ReadPassphrase()
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := DecryptDual(pass1, pass2, string(varmoredBytes))
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomically(outpath, plaintext)
+	if err != nil {
+		return fmt.Errorf("failed to write to %s: %s", outpath, err)
+	}
+
+	return nil
+}
+
+// estimateEntropyBits estimates the entropy of passphrase in bits, assuming each character was chosen uniformly at
+// random from the union of the character classes that appear in it. This is an upper bound; passphrases chosen by
+// humans typically have far less entropy than this suggests.
+func estimateEntropyBits(passphrase string) float64 {
+	var lower, upper, digit, symbol, other bool
+	length := 0
+	for _, r := range passphrase {
+		length++
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r >= ' ' && r <= '~':
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		present bool
+		size    int
+	}{
+		{lower, 26},
+		{upper, 26},
+		{digit, 10},
+		{symbol, 33}, // Printable ASCII other than letters and digits, including space.
+		{other, 100}, // A rough allowance for non-ASCII characters.
+	} {
+		if class.present {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+
+	return float64(length) * math.Log2(float64(pool))
+}
+
+// PassphraseEntropy reads a candidate passphrase from pr and writes an estimate of its entropy (see
+// estimateEntropyBits) to w. The passphrase itself is neither written nor stored.
+func PassphraseEntropy(pr preader.PassphraseReader, w io.Writer) error {
+	passphrase, err := pr.ReadPassphrase()
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "Estimated entropy: %.1f bits (an upper bound based on length and character classes)\n",
+		estimateEntropyBits(passphrase))
+	if err != nil {
+		return fmt.Errorf("failed to write output: %s", err)
+	}
+
+	return nil
+}
+
+// RunAgent runs a passphrase agent (see the agent package) listening on a new unix socket at socketPath, caching
+// a passphrase for ttl after it is stored. It runs until interrupted, removing the socket before returning.
+func RunAgent(socketPath string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive, was %s", ttl)
+	}
+
+	l, err := agent.Listen(socketPath)
+	if err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		<-signals
+		// Closing also removes the socket.
+		_ = l.Close()
+	}()
+
+	_, err = fmt.Fprintf(os.Stderr, "Agent listening; to use it run:\n  export %s=%s\n", agent.SocketEnv, socketPath)
+	if err != nil {
+		_ = l.Close()
+		return err
+	}
+
+	if err = agent.Serve(l, ttl); err != nil && !errors.Is(err, net.ErrClosed) {
+		return fmt.Errorf("agent failed: %s", err)
+	}
+
+	return nil
+}
+
+// ClearAgent removes any cached passphrase from the agent listening on the unix socket at socketPath.
+func ClearAgent(socketPath string) error {
+	if socketPath == "" {
+		return fmt.Errorf("no agent socket specified; is %s set?", agent.SocketEnv)
+	}
+
+	return agent.Clear(socketPath)
+}
+
+// SplitPassphrase splits the passphrase read from pr into the given number of Shamir shares, any threshold of
+// which are sufficient to reconstruct it. The armored shares are written to w, one per line.
+//
+// The shares can later be combined using preader.NewShares.
+func SplitPassphrase(pr preader.PassphraseReader, shares int, threshold int, w io.Writer) error {
+	passphrase, err := pr.ReadPassphrase()
+	if err != nil {
+		return err
+	}
+
+	split, err := shamir.Split([]byte(passphrase), shares, threshold)
+	if err != nil {
+		return fmt.Errorf("failed to split passphrase: %s", err)
+	}
+
+	for _, share := range split {
+		if _, err = fmt.Fprintln(w, shamir.ArmorShare(share)); err != nil {
+			return fmt.Errorf("failed to write share: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// Wrap armors everything read from r (without encrypting it) and writes the armored string to w.
+func Wrap(r io.Reader, w io.Writer) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read input: %s", err)
+	}
+
+	if _, err = io.WriteString(w, varmor.Wrap(body)); err != nil {
+		return fmt.Errorf("failed to write output: %s", err)
+	}
+
+	return nil
+}
+
+// Unwrap unarmors the armored string read from r (without decrypting it) and writes the resulting bytes to w.
+func Unwrap(r io.Reader, w io.Writer) error {
+	armored, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read input: %s", err)
+	}
+
+	body, err := varmor.Unwrap(string(armored))
+	if err != nil {
+		return fmt.Errorf("failed to unarmor: %s", err)
+	}
+
+	if _, err = w.Write(body); err != nil {
+		return fmt.Errorf("failed to write output: %s", err)
+	}
+
+	return nil
+}
+
+// Reencode reads armored blobs from r, one per line, and writes each to w re-armored using the encoding named
+// to (see varmor.Encodings). Nothing is decrypted, so no passphrase is needed. If from is not empty, every blob
+// must be in that encoding. Empty lines are passed through unchanged, so that output lines correspond to input
+// lines.
+func Reencode(r io.Reader, w io.Writer, from string, to string) error {
+	if from == "pem" || to == "pem" {
+		return errors.New("the pem encoding spans multiple lines, so cannot be used with one blob per line")
+	}
+	if from != "" {
+		if _, err := varmor.WrapWith(from, nil); err != nil {
+			return err
+		}
+	}
+	if _, err := varmor.WrapWith(to, nil); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(r)
+	for lineno := 1; ; lineno++ {
+		line, readErr := br.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return fmt.Errorf("failed to read input: %s", readErr)
+		}
+		if readErr == io.EOF && line == "" {
+			return nil
+		}
+
+		armored := strings.TrimRight(line, "\r\n")
+		reencoded := ""
+		if armored != "" {
+			if encoding, ok := varmor.EncodingOf(armored); ok && from != "" && encoding != from {
+				return fmt.Errorf("line %d: blob is in the %s encoding, not %s", lineno, encoding, from)
+			}
+
+			body, err := varmor.Unwrap(armored)
+			if err != nil {
+				return fmt.Errorf("line %d: failed to unarmor: %s", lineno, err)
+			}
+			reencoded, err = varmor.WrapWith(to, body)
+			if err != nil {
+				return err
+			}
+		}
+
+		if _, err := fmt.Fprintln(w, reencoded); err != nil {
+			return fmt.Errorf("failed to write output: %s", err)
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+	}
+}
+
+// parseSize parses a size such as "100MB" into a number of bytes. The suffixes KB, MB and GB denote powers of
+// 1024. A number without a suffix (or with the suffix B) is a number of bytes.
+func parseSize(size string) (int64, error) {
+	multipliers := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"KB", 1 << 10},
+		{"MB", 1 << 20},
+		{"GB", 1 << 30},
+		{"B", 1},
+	}
+
+	number := strings.TrimSpace(strings.ToUpper(size))
+	multiplier := int64(1)
+	for _, m := range multipliers {
+		if strings.HasSuffix(number, m.suffix) {
+			number = strings.TrimSuffix(number, m.suffix)
+			multiplier = m.multiplier
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q; expected a positive number optionally followed by B, KB, MB or GB", size)
+	}
+
+	return n * multiplier, nil
+}
+
+// parseAge parses an age such as "90d" or "12h". In addition to the units accepted by time.ParseDuration, the
+// suffixes d and w denote days and weeks.
+func parseAge(age string) (time.Duration, error) {
+	units := []struct {
+		suffix string
+		unit   time.Duration
+	}{
+		{"d", 24 * time.Hour},
+		{"w", 7 * 24 * time.Hour},
+	}
+
+	s := strings.TrimSpace(age)
+	d, err := time.ParseDuration(s)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			var n int64
+			n, err = strconv.ParseInt(strings.TrimSuffix(s, u.suffix), 10, 64)
+			d = time.Duration(n) * u.unit
+			break
+		}
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid age %q; expected a positive duration such as 90d, 2w or 36h", age)
+	}
+
+	return d, nil
+}
+
+// checkAge returns an error if the file at inpath was last modified longer ago than maxAge (see parseAge).
+func checkAge(inpath string, maxAge string) error {
+	limit, err := parseAge(maxAge)
+	if err != nil {
+		return err
+	}
+	if isURL(inpath) {
+		return errors.New("a maximum age cannot be checked for URL inputs")
+	}
+
+	info, err := fsys.Stat(inpath)
+	if err != nil {
+		return &CommandError{Op: "stat", Path: inpath, Err: err}
+	}
+
+	age := time.Since(info.ModTime())
+	if age > limit {
+		return fmt.Errorf("%s was last modified %d days ago, exceeding the maximum age of %s; consider rotating the secret it contains and re-encrypting it",
+			inpath, int(age.Hours()/24), maxAge)
+	}
+
+	return nil
+}
+
+// BenchArmor times varmor.Wrap and varmor.Unwrap over size (see parseSize) random bytes and writes the
+// throughput and allocations of each to w. This is purely diagnostic.
+func BenchArmor(size string, w io.Writer) error {
+	n, err := parseSize(size)
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, n)
+	if _, err = rand.Read(data); err != nil {
+		return fmt.Errorf("rand.Read() should never fail, but did: %s", err)
+	}
+
+	var armored string
+	var unarmored []byte
+	benchmarks := []struct {
+		name string
+		run  func() error
+	}{
+		{"wrap", func() error {
+			armored = varmor.Wrap(data)
+			return nil
+		}},
+		{"unwrap", func() error {
+			unarmored, err = varmor.Unwrap(armored)
+			return err
+		}},
+	}
+
+	for _, b := range benchmarks {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		start := time.Now()
+		if err := b.run(); err != nil {
+			return fmt.Errorf("%s failed: %s", b.name, err)
+		}
+		elapsed := time.Since(start)
+		runtime.ReadMemStats(&after)
+
+		mbPerSec := float64(n) / (1 << 20) / elapsed.Seconds()
+		_, err := fmt.Fprintf(w, "%s: %.1f MB/s, %d allocs, %d bytes allocated\n", b.name, mbPerSec,
+			after.Mallocs-before.Mallocs, after.TotalAlloc-before.TotalAlloc)
+		if err != nil {
+			return fmt.Errorf("failed to write output: %s", err)
+		}
+	}
+
+	if !bytes.Equal(data, unarmored) {
+		return errors.New("unwrap did not return the original data; this is a bug")
+	}
+
+	return nil
+}
+
+// fieldEncoder returns the function encoding binary fields for display using the named encoding (hex or
+// base64).
+func fieldEncoder(encoding string) (func([]byte) string, error) {
+	switch encoding {
+	case "hex":
+		return hex.EncodeToString, nil
+	case "base64":
+		return base64.StdEncoding.EncodeToString, nil
+	default:
+		return nil, fmt.Errorf("unsupported field encoding %q; supported encodings are hex and base64", encoding)
+	}
+}
+
+// Info writes a description of the unencrypted framing of the saltybox file at inpath to w. No passphrase is
+// required and nothing is decrypted.
+//
+// If fields is "hex" or "base64", the salt and nounce are also written in that encoding (neither is secret). If
+// fields is empty, only lengths are written.
+func Info(inpath string, fields string, w io.Writer) error {
+	var encode func([]byte) string
+	if fields != "" {
+		var err error
+		if encode, err = fieldEncoder(fields); err != nil {
+			return err
+		}
+	}
+
+	varmoredBytes, err := fsys.ReadFile(inpath)
+	if err != nil {
+		return fmt.Errorf("failed to read from %s: %s", inpath, err)
+	}
+
+	cipherBytes, err := varmor.Unwrap(string(varmoredBytes))
+	if err != nil {
+		return fmt.Errorf("failed to unarmor: %s", err)
+	}
+
+	header, err := secretcrypt.Inspect(cipherBytes)
+	if err != nil {
+		return fmt.Errorf("failed to inspect: %s", err)
+	}
+
+	lines := []string{
+		fmt.Sprintf("salt length: %d", len(header.Salt)),
+		fmt.Sprintf("nounce length: %d", len(header.Nounce)),
+		fmt.Sprintf("sealed box length: %d", header.SealedBoxLen),
+		fmt.Sprintf("plaintext length: %d", header.SealedBoxLen-secretbox.Overhead),
+	}
+	if encode != nil {
+		lines = append(lines,
+			fmt.Sprintf("salt: %s", encode(header.Salt[:])),
+			fmt.Sprintf("nounce: %s", encode(header.Nounce[:])),
+		)
+	}
+
+	for _, line := range lines {
+		if _, err = fmt.Fprintln(w, line); err != nil {
+			return fmt.Errorf("failed to write output: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// RawBox writes the sealed box of the saltybox file at inpath to w, stripped of armor and of the salt, nounce
+// and length framing, in the given encoding (hex or base64). This is diagnostic; the sealed box is still
+// encrypted, and is preceded by a comment line saying so.
+func RawBox(inpath string, encoding string, w io.Writer) error {
+	encode, err := fieldEncoder(encoding)
+	if err != nil {
+		return err
+	}
+
+	varmoredBytes, err := fsys.ReadFile(inpath)
+	if err != nil {
+		return fmt.Errorf("failed to read from %s: %s", inpath, err)
+	}
+
+	cipherBytes, err := varmor.Unwrap(string(varmoredBytes))
+	if err != nil {
+		return fmt.Errorf("failed to unarmor: %s", err)
+	}
+
+	_, _, sealedBox, err := secretcrypt.Disassemble(cipherBytes)
+	if err != nil {
+		return fmt.Errorf("failed to inspect: %s", err)
+	}
+
+	_, err = fmt.Fprintf(w, "# STILL ENCRYPTED: NaCl secretbox sealed box (%d bytes, %s), not plain text\n%s\n",
+		len(sealedBox), encoding, encode(sealedBox))
+	if err != nil {
+		return fmt.Errorf("failed to write output: %s", err)
+	}
+
+	return nil
+}
+
+// Explain writes to w a breakdown of how large the saltybox file resulting from encrypting the file at inpath,
+// armored with armorEncoding (see varmor.Encodings; empty means the default), would be. Nothing is encrypted; only
+// the size of the input is used.
+func Explain(inpath string, armorEncoding string, w io.Writer) error {
+	if armorEncoding == "" {
+		armorEncoding = varmor.Encodings()[0]
+	}
+
+	info, err := fsys.Stat(inpath)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %s", inpath, err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("input %s is a directory; only files are supported", inpath)
+	}
+
+	plaintextLen := info.Size()
+	crypttextLen := secretcrypt.CiphertextLen(plaintextLen)
+	if int64(int(crypttextLen)) != crypttextLen {
+		return fmt.Errorf("input %s is too large to encrypt", inpath)
+	}
+	armoredLen, err := varmor.WrappedLenWith(armorEncoding, int(crypttextLen))
+	if err != nil {
+		return err
+	}
+
+	var header secretcrypt.Header
+	steps := []struct {
+		description string
+		added       int64
+	}{
+		{"plain text", plaintextLen},
+		{"+ secretbox overhead (authentication tag)", secretbox.Overhead},
+		{"+ salt", int64(len(header.Salt))},
+		{"+ nounce", int64(len(header.Nounce))},
+		{"+ sealed box length field", secretcrypt.HeaderLen - int64(len(header.Salt)) - int64(len(header.Nounce))},
+		{fmt.Sprintf("+ armor (%s encoding)", armorEncoding), int64(armoredLen) - crypttextLen},
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	total := int64(0)
+	for _, step := range steps {
+		total += step.added
+		if _, err = fmt.Fprintf(tw, "%s\t%d\t= %d bytes\n", step.description, step.added, total); err != nil {
+			return fmt.Errorf("failed to write output: %s", err)
+		}
+	}
+	if err = tw.Flush(); err != nil {
+		return fmt.Errorf("failed to write output: %s", err)
+	}
+
+	return nil
+}
+
+// formatLongDuration formats a possibly very long duration, given in seconds, using a suitably large unit.
+func formatLongDuration(seconds float64) string {
+	units := []struct {
+		name    string
+		seconds float64
+	}{
+		{"years", 365.25 * 24 * 60 * 60},
+		{"days", 24 * 60 * 60},
+		{"hours", 60 * 60},
+		{"minutes", 60},
+	}
+	for _, unit := range units {
+		if seconds >= unit.seconds {
+			return fmt.Sprintf("%.3g %s", seconds/unit.seconds, unit.name)
+		}
+	}
+
+	return fmt.Sprintf("%.3g seconds", seconds)
+}
+
+// KDFProfile performs a single key derivation for each of the given values of the scrypt N parameter (with the
+// other parameters at their defaults) and writes a table of the time taken and memory allocated by each to w. This
+// helps to size the number of concurrent derivations a machine can sustain.
+func KDFProfile(ns []int, w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if _, err := fmt.Fprintln(tw, "N\tr\tp\ttime\tallocated\texpected"); err != nil {
+		return fmt.Errorf("failed to write output: %s", err)
+	}
+
+	for _, n := range ns {
+		params := secretcrypt.DefaultParams()
+		params.N = n
+
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		elapsed, err := secretcrypt.MeasureKeyDerivation(params)
+		if err != nil {
+			return fmt.Errorf("key derivation with N=%d failed: %s", n, err)
+		}
+		runtime.ReadMemStats(&after)
+
+		_, err = fmt.Fprintf(tw, "%d\t%d\t%d\t%.3fs\t%.1f MiB\t%.1f MiB\n", params.N, params.R, params.P,
+			elapsed.Seconds(), float64(after.TotalAlloc-before.TotalAlloc)/(1<<20),
+			float64(secretcrypt.ScryptMemory(params))/(1<<20))
+		if err != nil {
+			return fmt.Errorf("failed to write output: %s", err)
+		}
+	}
+
+	if err := tw.Flush(); err != nil {
+		return fmt.Errorf("failed to write output: %s", err)
+	}
+
+	return nil
+}
+
+// CostEstimate writes to w a rough estimate of the expected time to brute-force the passphrase of the saltybox
+// file at inpath, assuming the passphrase has the given entropy in bits, by extrapolating from the time taken by
+// one real key derivation on this machine. No passphrase is required.
+//
+// Files do not record their key derivation parameters; all files use secretcrypt.DefaultParams. The input is
+// only validated, and the estimate is the same for every file.
+func CostEstimate(inpath string, entropyBits float64, w io.Writer) error {
+	if entropyBits <= 0 || entropyBits > 1024 {
+		return fmt.Errorf("entropy must be more than 0 and at most 1024 bits, was %g", entropyBits)
+	}
+
+	varmoredBytes, err := fsys.ReadFile(inpath)
+	if err != nil {
+		return fmt.Errorf("failed to read from %s: %s", inpath, err)
+	}
+
+	cipherBytes, err := varmor.Unwrap(string(varmoredBytes))
+	if err != nil {
+		return fmt.Errorf("failed to unarmor: %s", err)
+	}
+
+	if _, err = secretcrypt.Inspect(cipherBytes); err != nil {
+		return fmt.Errorf("failed to inspect: %s", err)
+	}
+
+	params := secretcrypt.DefaultParams()
+	perGuess, err := secretcrypt.MeasureKeyDerivation(params)
+	if err != nil {
+		return fmt.Errorf("failed to measure key derivation time: %s", err)
+	}
+
+	// On average half of the keyspace must be searched.
+	expectedGuesses := math.Pow(2, entropyBits-1)
+
+	lines := []string{
+		fmt.Sprintf("scrypt parameters (the same for all files): N=%d r=%d p=%d (~%d MiB of memory per guess)", params.N, params.R, params.P,
+			secretcrypt.ScryptMemory(params)>>20),
+		fmt.Sprintf("time per guess on this machine: ~%.3fs", perGuess.Seconds()),
+		fmt.Sprintf("expected guesses for a %g bit passphrase: ~%.3g", entropyBits, expectedGuesses),
+		fmt.Sprintf("expected time to brute-force on one such core: ~%s", formatLongDuration(expectedGuesses*perGuess.Seconds())),
+		"This is a rough estimate. A well funded attacker can perform many guesses in parallel on faster hardware.",
+	}
+	for _, line := range lines {
+		if _, err = fmt.Fprintln(w, line); err != nil {
+			return fmt.Errorf("failed to write output: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// ToDetached splits the saltybox file at inpath into its unencrypted header (salt, nounce and length), written
+// to headerPath, and its sealed box, written to bodyPath. Both are written as raw bytes. No passphrase is
+// required since nothing is decrypted.
+func ToDetached(inpath string, headerPath string, bodyPath string) error {
+	varmoredBytes, err := fsys.ReadFile(inpath)
+	if err != nil {
+		return fmt.Errorf("failed to read from %s: %s", inpath, err)
+	}
+
+	cipherBytes, err := varmor.Unwrap(string(varmoredBytes))
+	if err != nil {
+		return fmt.Errorf("failed to unarmor: %s", err)
+	}
+
+	header, err := secretcrypt.Inspect(cipherBytes)
+	if err != nil {
+		return fmt.Errorf("failed to inspect: %s", err)
+	}
+	if int64(len(cipherBytes)) != secretcrypt.HeaderLen+header.SealedBoxLen {
+		return errors.New("input contains trailing data after the sealed box; refusing to split")
+	}
+
+	err = fsys.WriteFile(headerPath, cipherBytes[:secretcrypt.HeaderLen], 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write to %s: %s", headerPath, err)
+	}
+
+	err = fsys.WriteFile(bodyPath, cipherBytes[secretcrypt.HeaderLen:], 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write to %s: %s", bodyPath, err)
+	}
+
+	return nil
+}
+
+// ToCombined is the inverse of ToDetached; it joins the header at headerPath and the sealed box at bodyPath
+// into a regular saltybox file written to outpath, armored with the named encoding (default if empty). Since the
+// detached form is raw bytes, the encoding of the file originally split is not known and must be given again to
+// reproduce it.
+func ToCombined(headerPath string, bodyPath string, outpath string, armorEncoding string) error {
+	if err := checkArmorEncoding(armorEncoding); err != nil {
+		return err
+	}
+
+	headerBytes, err := fsys.ReadFile(headerPath)
+	if err != nil {
+		return fmt.Errorf("failed to read from %s: %s", headerPath, err)
+	}
+	if len(headerBytes) != secretcrypt.HeaderLen {
+		return fmt.Errorf("header must be exactly %d bytes, was %d", secretcrypt.HeaderLen, len(headerBytes))
+	}
+
+	bodyBytes, err := fsys.ReadFile(bodyPath)
+	if err != nil {
+		return fmt.Errorf("failed to read from %s: %s", bodyPath, err)
+	}
+
+	cipherBytes := append(headerBytes, bodyBytes...)
+	header, err := secretcrypt.Inspect(cipherBytes)
+	if err != nil {
+		return fmt.Errorf("failed to inspect: %s", err)
+	}
+	if header.SealedBoxLen != int64(len(bodyBytes)) {
+		return fmt.Errorf("header claims a sealed box of %d bytes but body is %d bytes", header.SealedBoxLen, len(bodyBytes))
+	}
+
+	armored := varmor.Wrap(cipherBytes)
+	if armorEncoding != "" {
+		if armored, err = varmor.WrapWith(armorEncoding, cipherBytes); err != nil {
+			return err
+		}
+	}
+
+	err = fsys.WriteFile(outpath, []byte(armored), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write to %s: %s", outpath, err)
+	}
+
+	return nil
+}
+
+// ImportRaw armors the raw (unarmored) secretcrypt bytes at inpath, such as those produced by another
+// implementation of the format, and writes the resulting saltybox file to outpath. No passphrase is required since
+// nothing is decrypted, but the framing is validated.
+func ImportRaw(inpath string, outpath string) error {
+	if err := checkPaths(inpath, outpath); err != nil {
+		return err
+	}
+
+	cipherBytes, err := fsys.ReadFile(inpath)
+	if err != nil {
+		return fmt.Errorf("failed to read from %s: %s", inpath, err)
+	}
+
+	if _, err = secretcrypt.Inspect(cipherBytes); err != nil {
+		return fmt.Errorf("input is not valid raw secretcrypt data: %s", err)
+	}
+
+	err = fsys.WriteFile(outpath, []byte(varmor.Wrap(cipherBytes)), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write to %s: %s", outpath, err)
+	}
+
+	return nil
+}
+
+const ageArmorHeader = "-----BEGIN AGE ENCRYPTED FILE-----"
+
+// ToAge decrypts the saltybox file at inpath using the passphrase from pr and encrypts the plain text to the given
+// age recipients (such as "age1..." X25519 public keys), writing the resulting age file to outpath. The plain text
+// is never written to disk.
+func ToAge(inpath string, outpath string, recipients []string, pr preader.PassphraseReader) error {
+	if len(recipients) == 0 {
+		return errors.New("at least one age recipient is required")
+	}
+	var ageRecipients []age.Recipient
+	for _, recipient := range recipients {
+		ageRecipient, err := age.ParseX25519Recipient(recipient)
+		if err != nil {
+			return fmt.Errorf("invalid age recipient %s: %s", recipient, err)
+		}
+		ageRecipients = append(ageRecipients, ageRecipient)
+	}
+
+	if err := checkPaths(inpath, outpath); err != nil {
+		return err
+	}
+
+	varmoredBytes, err := fsys.ReadFile(inpath)
+	if err != nil {
+		return fmt.Errorf("failed to read from %s: %s", inpath, err)
+	}
+
+	passphrase, err := pr.ReadPassphrase()
+	if err != nil {
+		return err
+	}
+	plaintext, err := decryptString(passphrase, string(varmoredBytes))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt: %s", err)
+	}
+
+	var ageBytes bytes.Buffer
+	w, err := age.Encrypt(&ageBytes, ageRecipients...)
+	if err != nil {
+		return fmt.Errorf("age encryption failed: %s", err)
+	}
+	if _, err = w.Write(plaintext); err != nil {
+		return fmt.Errorf("age encryption failed: %s", err)
+	}
+	if err = w.Close(); err != nil {
+		return fmt.Errorf("age encryption failed: %s", err)
+	}
+
+	return writeFileAtomically(outpath, ageBytes.Bytes())
+}
+
+// FromAge decrypts the age file at inpath (binary or armored) using the identities in the file at identityPath
+// (in the format produced by age-keygen) and encrypts the plain text using the passphrase from pr, writing the
+// resulting saltybox file to outpath. The plain text is never written to disk.
+func FromAge(inpath string, outpath string, identityPath string, pr preader.PassphraseReader) error {
+	if err := checkPaths(inpath, outpath); err != nil {
+		return err
+	}
+
+	identityBytes, err := fsys.ReadFile(identityPath)
+	if err != nil {
+		return fmt.Errorf("failed to read from %s: %s", identityPath, err)
+	}
+	identities, err := age.ParseIdentities(bytes.NewReader(identityBytes))
+	if err != nil {
+		return fmt.Errorf("failed to parse age identities in %s: %s", identityPath, err)
+	}
+
+	ageBytes, err := fsys.ReadFile(inpath)
+	if err != nil {
+		return fmt.Errorf("failed to read from %s: %s", inpath, err)
+	}
+
+	var ageReader io.Reader = bytes.NewReader(ageBytes)
+	if bytes.HasPrefix(bytes.TrimSpace(ageBytes), []byte(ageArmorHeader)) {
+		ageReader = ageArmor.NewReader(bytes.NewReader(bytes.TrimSpace(ageBytes)))
+	}
+	r, err := age.Decrypt(ageReader, identities...)
+	if err != nil {
+		return fmt.Errorf("age decryption failed: %s", err)
+	}
+	plaintext, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("age decryption failed: %s", err)
+	}
+
+	passphrase, err := pr.ReadPassphrase()
+	if err != nil {
+		return err
+	}
+	encryptedString, err := encryptBytes(passphrase, plaintext)
+	if err != nil {
+		return fmt.Errorf("encryption failed: %s", err)
+	}
+
+	return writeFileAtomically(outpath, []byte(encryptedString))
+}
@@ -1,12 +1,27 @@
 package commands
 
 import (
+	"bytes"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
 	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"filippo.io/age"
+	ageArmor "filippo.io/age/armor"
 	"github.com/scode/saltybox/preader"
+	"github.com/scode/saltybox/secretcrypt"
+	"github.com/scode/saltybox/varmor"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -33,14 +48,14 @@ func TestEncryptDecryptUpdate(t *testing.T) {
 	encryptedPath := filepath.Join(tempdir, "encrypted")
 	defer checkedRemove(t, encryptedPath)
 
-	err = Encrypt(plainPath, encryptedPath, preader.NewConstant("test"))
+	err = Encrypt(plainPath, encryptedPath, preader.NewConstant("test"), EncryptOptions{})
 	assert.NoError(t, err)
 
 	newPlainPath := filepath.Join(tempdir, "newplain")
 	defer checkedRemove(t, newPlainPath)
 
 	// Decrypt
-	err = Decrypt(encryptedPath, newPlainPath, preader.NewConstant("test"))
+	err = Decrypt(encryptedPath, newPlainPath, preader.NewConstant("test"), DecryptOptions{})
 	assert.NoError(t, err)
 
 	newPlainText, err := ioutil.ReadFile(newPlainPath)
@@ -53,16 +68,16 @@ func TestEncryptDecryptUpdate(t *testing.T) {
 	assert.NoError(t, err)
 	defer checkedRemove(t, updatedPlainPath)
 
-	err = Update(updatedPlainPath, encryptedPath, preader.NewConstant("wrong"))
+	err = Update(updatedPlainPath, encryptedPath, preader.NewConstant("wrong"), UpdateOptions{})
 	assert.Error(t, err)
 
 	// Update with right passphrase
-	err = Update(updatedPlainPath, encryptedPath, preader.NewConstant("test"))
+	err = Update(updatedPlainPath, encryptedPath, preader.NewConstant("test"), UpdateOptions{})
 	assert.NoError(t, err)
 
 	newUpdatedPlainPath := filepath.Join(tempdir, "newupdatedplain")
 	defer checkedRemove(t, newUpdatedPlainPath)
-	err = Decrypt(encryptedPath, newUpdatedPlainPath, preader.NewConstant("test"))
+	err = Decrypt(encryptedPath, newUpdatedPlainPath, preader.NewConstant("test"), DecryptOptions{})
 	assert.NoError(t, err)
 
 	newUpdatedPlainText, err := ioutil.ReadFile(newUpdatedPlainPath)
@@ -86,7 +101,7 @@ func TestBackwardsCompatibility(t *testing.T) {
 	newPlainPath := filepath.Join(tempdir, "newplain")
 	defer checkedRemove(t, newPlainPath)
 
-	err = Decrypt(encryptedPath, newPlainPath, preader.NewConstant("test"))
+	err = Decrypt(encryptedPath, newPlainPath, preader.NewConstant("test"), DecryptOptions{})
 	assert.NoError(t, err)
 
 	newPlainText, err := ioutil.ReadFile(newPlainPath)
@@ -94,3 +109,1088 @@ func TestBackwardsCompatibility(t *testing.T) {
 
 	assert.EqualValues(t, []byte("test"), newPlainText)
 }
+
+func TestRecover(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "saltyboxtest")
+	if !assert.NoError(t, err) {
+		assert.FailNow(t, "failed to create temporary directory")
+	}
+	defer checkedRemove(t, tempdir)
+
+	plainPath := filepath.Join(tempdir, "plain")
+	err = ioutil.WriteFile(plainPath, []byte("super secret"), 0600)
+	assert.NoError(t, err)
+	defer checkedRemove(t, plainPath)
+
+	encryptedPath := filepath.Join(tempdir, "encrypted")
+	err = Encrypt(plainPath, encryptedPath, preader.NewConstant("test"), EncryptOptions{})
+	assert.NoError(t, err)
+	defer checkedRemove(t, encryptedPath)
+
+	wordlistPath := filepath.Join(tempdir, "wordlist")
+	err = ioutil.WriteFile(wordlistPath, []byte("wrong1\nwrong2\ntest\nwrong3\n"), 0600)
+	assert.NoError(t, err)
+	defer checkedRemove(t, wordlistPath)
+
+	var progress bytes.Buffer
+	passphrase, found, err := Recover(encryptedPath, wordlistPath, 2, &progress)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "test", passphrase)
+	assert.Contains(t, progress.String(), "candidates")
+
+	// No matching candidate.
+	err = ioutil.WriteFile(wordlistPath, []byte("wrong1\nwrong2\n"), 0600)
+	assert.NoError(t, err)
+
+	_, found, err = Recover(encryptedPath, wordlistPath, 2, &progress)
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestDecryptStrings(t *testing.T) {
+	encrypted, err := encryptBytes("test", []byte("super secret"))
+	assert.NoError(t, err)
+
+	plaintexts, errs := DecryptStrings("test", []string{encrypted, "not saltybox"})
+	assert.NoError(t, errs[0])
+	assert.Equal(t, []byte("super secret"), plaintexts[0])
+	assert.Error(t, errs[1])
+	assert.Nil(t, plaintexts[1])
+}
+
+func TestStegoEmbedExtract(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "saltyboxtest")
+	if !assert.NoError(t, err) {
+		assert.FailNow(t, "failed to create temporary directory")
+	}
+	defer checkedRemove(t, tempdir)
+
+	plainPath := filepath.Join(tempdir, "plain")
+	err = ioutil.WriteFile(plainPath, []byte("super secret"), 0600)
+	assert.NoError(t, err)
+	defer checkedRemove(t, plainPath)
+
+	var coverBuf bytes.Buffer
+	err = png.Encode(&coverBuf, image.NewNRGBA(image.Rect(0, 0, 64, 64)))
+	assert.NoError(t, err)
+	coverPath := filepath.Join(tempdir, "cover.png")
+	err = ioutil.WriteFile(coverPath, coverBuf.Bytes(), 0600)
+	assert.NoError(t, err)
+	defer checkedRemove(t, coverPath)
+
+	stegoPath := filepath.Join(tempdir, "stego.png")
+	err = StegoEmbed(plainPath, coverPath, stegoPath, preader.NewConstant("test"))
+	assert.NoError(t, err)
+	defer checkedRemove(t, stegoPath)
+
+	extractedPath := filepath.Join(tempdir, "extracted")
+	err = StegoExtract(stegoPath, extractedPath, preader.NewConstant("test"))
+	assert.NoError(t, err)
+	defer checkedRemove(t, extractedPath)
+
+	extracted, err := ioutil.ReadFile(extractedPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("super secret"), extracted)
+
+	// A cover too small to hold the data must be rejected.
+	coverBuf.Reset()
+	err = png.Encode(&coverBuf, image.NewNRGBA(image.Rect(0, 0, 4, 4)))
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(coverPath, coverBuf.Bytes(), 0600)
+	assert.NoError(t, err)
+
+	err = StegoEmbed(plainPath, coverPath, filepath.Join(tempdir, "toosmall.png"), preader.NewConstant("test"))
+	assert.Error(t, err)
+}
+
+func TestRekey(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "saltyboxtest")
+	if !assert.NoError(t, err) {
+		assert.FailNow(t, "failed to create temporary directory")
+	}
+	defer checkedRemove(t, tempdir)
+
+	plainPath := filepath.Join(tempdir, "plain")
+	err = ioutil.WriteFile(plainPath, []byte("super secret"), 0600)
+	assert.NoError(t, err)
+	defer checkedRemove(t, plainPath)
+
+	keyPath := filepath.Join(tempdir, "key")
+	err = ioutil.WriteFile(keyPath, []byte{0, 1, 2, 3, 4, 5, 6, 7}, 0600)
+	assert.NoError(t, err)
+	defer checkedRemove(t, keyPath)
+
+	encryptedPath := filepath.Join(tempdir, "encrypted")
+	err = Encrypt(plainPath, encryptedPath, preader.NewConstant("test"), EncryptOptions{})
+	assert.NoError(t, err)
+	defer checkedRemove(t, encryptedPath)
+
+	// Wrong passphrase must fail and leave the file decryptable with the original passphrase.
+	err = Rekey(encryptedPath, preader.NewConstant("wrong"), preader.NewFile(keyPath))
+	assert.Error(t, err)
+
+	err = Rekey(encryptedPath, preader.NewConstant("test"), preader.NewFile(keyPath))
+	assert.NoError(t, err)
+
+	newPlainPath := filepath.Join(tempdir, "newplain")
+	defer checkedRemove(t, newPlainPath)
+
+	err = Decrypt(encryptedPath, newPlainPath, preader.NewConstant("test"), DecryptOptions{})
+	assert.Error(t, err)
+	err = Decrypt(encryptedPath, newPlainPath, preader.NewFile(keyPath), DecryptOptions{})
+	assert.NoError(t, err)
+
+	// And back again.
+	err = Rekey(encryptedPath, preader.NewFile(keyPath), preader.NewConstant("test"))
+	assert.NoError(t, err)
+	err = Decrypt(encryptedPath, newPlainPath, preader.NewConstant("test"), DecryptOptions{})
+	assert.NoError(t, err)
+
+	newPlainText, err := ioutil.ReadFile(newPlainPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("super secret"), newPlainText)
+}
+
+func TestDecryptSecureTmp(t *testing.T) {
+	dir, err := secureTmpDir()
+	if err != nil {
+		t.Skipf("no RAM-backed directory available: %s", err)
+	}
+
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+	assert.NoError(t, mfs.MkdirAll(dir, 0700))
+
+	mfs.files["plain"] = []byte("super secret")
+	err = Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{})
+	assert.NoError(t, err)
+
+	// The output is written inside a new private directory, never at a predictable path.
+	mfs.files[filepath.Join(dir, "newplain")] = []byte("planted")
+	err = Decrypt("encrypted", "some/dir/newplain", preader.NewConstant("test"), DecryptOptions{SecureTmp: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("planted"), mfs.files[filepath.Join(dir, "newplain")])
+	assert.NotContains(t, mfs.files, "some/dir/newplain")
+
+	outpath := filepath.Join(dir, fmt.Sprintf("saltybox-%d", mfs.tempCount), "newplain")
+	assert.Equal(t, []byte("super secret"), mfs.files[outpath])
+}
+
+func TestCreateExclusive(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "saltyboxtest")
+	if !assert.NoError(t, err) {
+		assert.FailNow(t, "failed to create temporary directory")
+	}
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempdir))
+	}()
+
+	target := filepath.Join(tempdir, "target")
+	assert.NoError(t, ioutil.WriteFile(target, []byte("original"), 0600))
+	link := filepath.Join(tempdir, "link")
+	if err = os.Symlink(target, link); err != nil {
+		t.Skipf("symlinks not supported: %s", err)
+	}
+
+	// Neither an existing file nor a symlink is written through.
+	for _, path := range []string{target, link} {
+		_, err = osFileSystem{}.CreateExclusive(path, 0600)
+		assert.Error(t, err, path)
+	}
+	data, err := ioutil.ReadFile(target)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("original"), data)
+
+	f, err := osFileSystem{}.CreateExclusive(filepath.Join(tempdir, "new"), 0600)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+}
+
+func TestSplitPassphrase(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "saltyboxtest")
+	if !assert.NoError(t, err) {
+		assert.FailNow(t, "failed to create temporary directory")
+	}
+	defer checkedRemove(t, tempdir)
+
+	var shares bytes.Buffer
+	err = SplitPassphrase(preader.NewConstant("test"), 5, 3, &shares)
+	assert.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(shares.String()), "\n")
+	assert.Len(t, lines, 5)
+
+	sharesPath := filepath.Join(tempdir, "shares")
+	err = ioutil.WriteFile(sharesPath, []byte(strings.Join(lines[1:4], "\n")), 0600)
+	assert.NoError(t, err)
+	defer checkedRemove(t, sharesPath)
+
+	passphrase, err := preader.NewShares(sharesPath).ReadPassphrase()
+	assert.NoError(t, err)
+	assert.Equal(t, "test", passphrase)
+}
+
+func TestEncryptMmap(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "saltyboxtest")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tmpdir))
+	}()
+
+	plainPath := filepath.Join(tmpdir, "plain")
+	emptyPath := filepath.Join(tmpdir, "empty")
+	encryptedPath := filepath.Join(tmpdir, "encrypted")
+	newPlainPath := filepath.Join(tmpdir, "newplain")
+	assert.NoError(t, ioutil.WriteFile(plainPath, []byte("super secret"), 0600))
+	assert.NoError(t, ioutil.WriteFile(emptyPath, []byte{}, 0600))
+
+	// Empty files cannot be mapped, and must fall back to being read.
+	for path, expected := range map[string]string{plainPath: "super secret", emptyPath: ""} {
+		err = Encrypt(path, encryptedPath, preader.NewConstant("test"), EncryptOptions{Mmap: true})
+		assert.NoError(t, err)
+
+		err = Decrypt(encryptedPath, newPlainPath, preader.NewConstant("test"), DecryptOptions{})
+		assert.NoError(t, err)
+		newPlain, err := ioutil.ReadFile(newPlainPath)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(newPlain))
+	}
+
+	err = Encrypt(filepath.Join(tmpdir, "missing"), encryptedPath, preader.NewConstant("test"), EncryptOptions{Mmap: true})
+	assert.Error(t, err)
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	var wrapped bytes.Buffer
+	err := Wrap(strings.NewReader("not secret"), &wrapped)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(wrapped.String(), "saltybox1:"))
+
+	var unwrapped bytes.Buffer
+	err = Unwrap(&wrapped, &unwrapped)
+	assert.NoError(t, err)
+	assert.Equal(t, "not secret", unwrapped.String())
+
+	err = Unwrap(strings.NewReader("not armored"), &unwrapped)
+	assert.Error(t, err)
+}
+
+func TestReencode(t *testing.T) {
+	url1 := varmor.Wrap([]byte("one"))
+	url2 := varmor.Wrap([]byte("two"))
+	b32, err := varmor.WrapWith("base32", []byte("three"))
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	err = Reencode(strings.NewReader(url1+"\n\n"+url2+"\r\n"+b32), &out, "", "base32")
+	assert.NoError(t, err)
+
+	lines := strings.Split(out.String(), "\n")
+	assert.Len(t, lines, 5)
+	assert.Equal(t, "", lines[1])
+	assert.Equal(t, b32, lines[3])
+	assert.Equal(t, "", lines[4])
+	for i, expected := range []string{"one", "", "two", "three"} {
+		if expected == "" {
+			continue
+		}
+		encoding, ok := varmor.EncodingOf(lines[i])
+		assert.True(t, ok)
+		assert.Equal(t, "base32", encoding)
+		body, err := varmor.Unwrap(lines[i])
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(body))
+	}
+
+	// Blobs not in the --from encoding are rejected, identifying the line.
+	out.Reset()
+	err = Reencode(strings.NewReader(url1+"\n"+b32+"\n"), &out, "url", "std")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "line 2")
+
+	err = Reencode(strings.NewReader("not armored\n"), &out, "", "std")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "line 1")
+
+	err = Reencode(strings.NewReader(url1), &out, "", "nonexistent")
+	assert.Error(t, err)
+	err = Reencode(strings.NewReader(url1), &out, "nonexistent", "url")
+	assert.Error(t, err)
+	err = Reencode(strings.NewReader(url1), &out, "", "pem")
+	assert.Error(t, err)
+}
+
+func TestInfo(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	mfs.files["encrypted"] = []byte("saltybox1:RF0qX8mpCMXVBq6zxHfamdiT64s6Pwvb99Qj9gV61sMAAAAAAAAAFE6RVTWMhBCMJGL0MmgdDUBHoJaW")
+
+	var out bytes.Buffer
+	err := Info("encrypted", "", &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "salt length: 8\nnounce length: 24\nsealed box length: 20\nplaintext length: 4\n", out.String())
+
+	out.Reset()
+	err = Info("encrypted", "hex", &out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "salt: 445d2a5fc9a908c5\n")
+	assert.Contains(t, out.String(), "nounce: ")
+
+	out.Reset()
+	err = Info("encrypted", "base64", &out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "salt: RF0qX8mpCMU=\n")
+
+	err = Info("encrypted", "octal", &out)
+	assert.Error(t, err)
+}
+
+func TestExplain(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	mfs.files["plain"] = []byte("super secret")
+
+	var out bytes.Buffer
+	err := Explain("plain", "", &out)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	assert.Len(t, lines, 6)
+	assert.True(t, strings.HasPrefix(lines[0], "plain text"))
+	assert.True(t, strings.HasSuffix(lines[4], "= 68 bytes"))
+
+	// The final size must match what encrypting actually produces.
+	for _, encoding := range varmor.Encodings() {
+		out.Reset()
+		err = Explain("plain", encoding, &out)
+		assert.NoError(t, err)
+
+		err = Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{ArmorEncoding: encoding})
+		assert.NoError(t, err)
+		assert.True(t, strings.HasSuffix(out.String(), fmt.Sprintf("= %d bytes\n", len(mfs.files["encrypted"]))),
+			"encoding %s: %s", encoding, out.String())
+	}
+
+	err = Explain("plain", "rot13", &out)
+	assert.Error(t, err)
+	err = Explain("missing", "", &out)
+	assert.Error(t, err)
+}
+
+func TestRawBox(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	mfs.files["encrypted"] = []byte("saltybox1:RF0qX8mpCMXVBq6zxHfamdiT64s6Pwvb99Qj9gV61sMAAAAAAAAAFE6RVTWMhBCMJGL0MmgdDUBHoJaW")
+
+	var out bytes.Buffer
+	err := RawBox("encrypted", "hex", &out)
+	assert.NoError(t, err)
+	lines := strings.Split(out.String(), "\n")
+	assert.Len(t, lines, 3)
+	assert.Contains(t, lines[0], "STILL ENCRYPTED")
+	assert.Equal(t, "4e9155358c84108c2462f432681d0d4047a09696", lines[1])
+
+	out.Reset()
+	err = RawBox("encrypted", "base64", &out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "\nTpFVNYyEEIwkYvQyaB0NQEeglpY=\n")
+
+	err = RawBox("encrypted", "base32", &out)
+	assert.Error(t, err)
+
+	mfs.files["corrupt"] = []byte("saltybox1:AAAA")
+	err = RawBox("corrupt", "hex", &out)
+	assert.Error(t, err)
+}
+
+func TestMissingOutputDirectory(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "saltyboxtest")
+	if !assert.NoError(t, err) {
+		assert.FailNow(t, "failed to create temporary directory")
+	}
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempdir))
+	}()
+
+	plainPath := filepath.Join(tempdir, "plain")
+	err = ioutil.WriteFile(plainPath, []byte("super secret"), 0600)
+	assert.NoError(t, err)
+
+	// Without --mkdir, a helpful error is returned.
+	encryptedPath := filepath.Join(tempdir, "sub", "dir", "encrypted")
+	err = Encrypt(plainPath, encryptedPath, preader.NewConstant("test"), EncryptOptions{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "output directory does not exist")
+	assert.Contains(t, err.Error(), "--mkdir")
+
+	// With --mkdir, the directory is created.
+	err = Encrypt(plainPath, encryptedPath, preader.NewConstant("test"), EncryptOptions{Mkdir: true})
+	assert.NoError(t, err)
+
+	newPlainPath := filepath.Join(tempdir, "other", "newplain")
+	err = Decrypt(encryptedPath, newPlainPath, preader.NewConstant("test"), DecryptOptions{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "--mkdir")
+
+	err = Decrypt(encryptedPath, newPlainPath, preader.NewConstant("test"), DecryptOptions{Mkdir: true})
+	assert.NoError(t, err)
+
+	newPlainText, err := ioutil.ReadFile(newPlainPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("super secret"), newPlainText)
+
+	// Atomic writes into a missing directory also fail helpfully.
+	err = writeFileAtomically(filepath.Join(tempdir, "missing", "file"), []byte("data"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "directory does not exist")
+}
+
+func TestDetachedRoundTrip(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	original := []byte("saltybox1:RF0qX8mpCMXVBq6zxHfamdiT64s6Pwvb99Qj9gV61sMAAAAAAAAAFE6RVTWMhBCMJGL0MmgdDUBHoJaW")
+	mfs.files["encrypted"] = original
+
+	err := ToDetached("encrypted", "header", "body")
+	assert.NoError(t, err)
+	assert.Len(t, mfs.files["header"], secretcrypt.HeaderLen)
+	assert.Len(t, mfs.files["body"], 20)
+
+	err = ToCombined("header", "body", "combined", "")
+	assert.NoError(t, err)
+	assert.Equal(t, original, mfs.files["combined"])
+
+	// Other encodings must be given again.
+	err = ToCombined("header", "body", "combined", "base32")
+	assert.NoError(t, err)
+	encoding, _ := varmor.EncodingOf(string(mfs.files["combined"]))
+	assert.Equal(t, "base32", encoding)
+	combined, err := varmor.Unwrap(string(mfs.files["combined"]))
+	assert.NoError(t, err)
+	assert.Equal(t, append(mfs.files["header"], mfs.files["body"]...), combined)
+
+	err = ToCombined("header", "body", "combined", "rot13")
+	assert.Error(t, err)
+
+	// A body not matching the header's declared length is rejected.
+	mfs.files["body"] = mfs.files["body"][1:]
+	err = ToCombined("header", "body", "combined", "")
+	assert.Error(t, err)
+}
+
+func TestEncryptVerifyAfterWrite(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	mfs.files["plain"] = []byte("super secret")
+
+	err := Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{VerifyAfterWrite: true})
+	assert.NoError(t, err)
+
+	mfs.corruptWrites = true
+	err = Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{VerifyAfterWrite: true})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "verification failed")
+}
+
+func TestDirectoryPaths(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "saltyboxtest")
+	if !assert.NoError(t, err) {
+		assert.FailNow(t, "failed to create temporary directory")
+	}
+	defer checkedRemove(t, tempdir)
+
+	plainPath := filepath.Join(tempdir, "plain")
+	err = ioutil.WriteFile(plainPath, []byte("super secret"), 0600)
+	assert.NoError(t, err)
+	defer checkedRemove(t, plainPath)
+
+	// Directory as input.
+	err = Encrypt(tempdir, filepath.Join(tempdir, "encrypted"), preader.NewConstant("test"), EncryptOptions{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "is a directory")
+
+	err = Decrypt(tempdir, filepath.Join(tempdir, "decrypted"), preader.NewConstant("test"), DecryptOptions{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "is a directory")
+
+	// Directory as output.
+	err = Encrypt(plainPath, tempdir, preader.NewConstant("test"), EncryptOptions{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "is an existing directory")
+
+	err = Decrypt(plainPath, tempdir, preader.NewConstant("test"), DecryptOptions{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "is an existing directory")
+}
+
+type countingPassphraseReader struct {
+	passphrase string
+	count      int
+}
+
+func (r *countingPassphraseReader) ReadPassphrase() (string, error) {
+	r.count++
+	return r.passphrase, nil
+}
+
+func TestEncryptOnlyIfChanged(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	mfs.files["plain"] = []byte("super secret")
+	pr := &countingPassphraseReader{passphrase: "test"}
+
+	err := Encrypt("plain", "encrypted", pr, EncryptOptions{OnlyIfChanged: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pr.count)
+	assert.Contains(t, mfs.files, "encrypted.meta")
+	assert.NotContains(t, string(mfs.files["encrypted.meta"]), "super secret")
+	encrypted := mfs.files["encrypted"]
+
+	// Unchanged: skipped without reading the passphrase.
+	err = Encrypt("plain", "encrypted", pr, EncryptOptions{OnlyIfChanged: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pr.count)
+	assert.Equal(t, encrypted, mfs.files["encrypted"])
+
+	// Changed: encrypted again.
+	mfs.files["plain"] = []byte("updated super secret")
+	err = Encrypt("plain", "encrypted", pr, EncryptOptions{OnlyIfChanged: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, pr.count)
+	assert.NotEqual(t, encrypted, mfs.files["encrypted"])
+
+	// Missing output: encrypted again even though the sidecar matches.
+	delete(mfs.files, "encrypted")
+	err = Encrypt("plain", "encrypted", pr, EncryptOptions{OnlyIfChanged: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, pr.count)
+	assert.Contains(t, mfs.files, "encrypted")
+}
+
+func TestDecryptURL(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "saltyboxtest")
+	if !assert.NoError(t, err) {
+		assert.FailNow(t, "failed to create temporary directory")
+	}
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempdir))
+	}()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte("saltybox1:RF0qX8mpCMXVBq6zxHfamdiT64s6Pwvb99Qj9gV61sMAAAAAAAAAFE6RVTWMhBCMJGL0MmgdDUBHoJaW"))
+	}))
+	defer server.Close()
+
+	caPath := filepath.Join(tempdir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	err = ioutil.WriteFile(caPath, caPEM, 0600)
+	assert.NoError(t, err)
+
+	newPlainPath := filepath.Join(tempdir, "newplain")
+
+	// Untrusted certificate.
+	err = Decrypt(server.URL, newPlainPath, preader.NewConstant("test"), DecryptOptions{
+		HTTPHeaders: []string{"Authorization: Bearer token"},
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to fetch")
+
+	// Missing header.
+	err = Decrypt(server.URL, newPlainPath, preader.NewConstant("test"), DecryptOptions{CAFile: caPath})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "403")
+
+	err = Decrypt(server.URL, newPlainPath, preader.NewConstant("test"), DecryptOptions{
+		HTTPHeaders: []string{"Authorization: Bearer token"},
+		CAFile:      caPath,
+	})
+	assert.NoError(t, err)
+
+	newPlainText, err := ioutil.ReadFile(newPlainPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test"), newPlainText)
+}
+
+func TestEncryptArmorEncoding(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	mfs.files["plain"] = []byte("super secret")
+
+	err := Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{ArmorEncoding: "base32"})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(mfs.files["encrypted"]), "saltybox1b32:"))
+
+	err = Decrypt("encrypted", "newplain", preader.NewConstant("test"), DecryptOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("super secret"), mfs.files["newplain"])
+
+	err = Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{ArmorEncoding: "pem"})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(mfs.files["encrypted"]), "-----BEGIN SALTYBOX-----\n"))
+	assert.True(t, strings.HasSuffix(string(mfs.files["encrypted"]), "\n-----END SALTYBOX-----\n"))
+
+	err = Decrypt("encrypted", "newplain", preader.NewConstant("test"), DecryptOptions{Strict: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("super secret"), mfs.files["newplain"])
+
+	err = Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{ArmorEncoding: "rot13"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "supported encodings are: url, std, base32, pem")
+}
+
+func TestGenKeyfile(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	err := GenKeyfile("key", 32, false)
+	assert.NoError(t, err)
+	key := mfs.files["key"]
+	assert.Len(t, key, 32)
+
+	// Must refuse to destroy an existing key.
+	err = GenKeyfile("key", 32, false)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "--force")
+	assert.Equal(t, key, mfs.files["key"])
+
+	err = GenKeyfile("key", 16, true)
+	assert.NoError(t, err)
+	assert.Len(t, mfs.files["key"], 16)
+
+	err = GenKeyfile("otherkey", 0, false)
+	assert.Error(t, err)
+}
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]int64{
+		"1":     1,
+		"10B":   10,
+		"2kb":   2 << 10,
+		"100MB": 100 << 20,
+		"1 GB":  1 << 30,
+	}
+	for size, expected := range cases {
+		n, err := parseSize(size)
+		assert.NoError(t, err, size)
+		assert.Equal(t, expected, n, size)
+	}
+
+	for _, size := range []string{"", "MB", "-1MB", "0", "1TB", "lots"} {
+		_, err := parseSize(size)
+		assert.Error(t, err, size)
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	cases := map[string]time.Duration{
+		"90d":   90 * 24 * time.Hour,
+		"2w":    14 * 24 * time.Hour,
+		"36h":   36 * time.Hour,
+		" 1d ":  24 * time.Hour,
+		"1h30m": 90 * time.Minute,
+	}
+	for age, expected := range cases {
+		d, err := parseAge(age)
+		assert.NoError(t, err, age)
+		assert.Equal(t, expected, d, age)
+	}
+
+	for _, age := range []string{"", "d", "-1d", "0d", "1y", "soon"} {
+		_, err := parseAge(age)
+		assert.Error(t, err, age)
+	}
+}
+
+func TestBenchArmor(t *testing.T) {
+	var out bytes.Buffer
+	err := BenchArmor("1KB", &out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "wrap: ")
+	assert.Contains(t, out.String(), "unwrap: ")
+
+	err = BenchArmor("nonsense", &out)
+	assert.Error(t, err)
+}
+
+func TestEncryptNoEmptyPassphrase(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	mfs.files["plain"] = []byte("super secret")
+
+	err := Encrypt("plain", "encrypted", preader.NewConstant(""), EncryptOptions{NoEmptyPassphrase: true})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "empty passphrase")
+	assert.NotContains(t, mfs.files, "encrypted")
+
+	// Without the option empty passphrases remain accepted, and existing files must remain decryptable.
+	err = Encrypt("plain", "encrypted", preader.NewConstant(""), EncryptOptions{})
+	assert.NoError(t, err)
+	err = Decrypt("encrypted", "newplain", preader.NewConstant(""), DecryptOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("super secret"), mfs.files["newplain"])
+}
+
+func TestDecryptStrict(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	mfs.files["plain"] = []byte("super secret")
+	err := Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{})
+	assert.NoError(t, err)
+
+	err = Decrypt("encrypted", "newplain", preader.NewConstant("test"), DecryptOptions{Strict: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("super secret"), mfs.files["newplain"])
+
+	// Must be rejected before the passphrase is read.
+	mfs.files["encrypted"] = append(mfs.files["encrypted"], '\n')
+	pr := &countingPassphraseReader{passphrase: "test"}
+	err = Decrypt("encrypted", "newplain", pr, DecryptOptions{Strict: true})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "non-canonical")
+	assert.Equal(t, 0, pr.count)
+
+	err = Decrypt("encrypted", "newplain", preader.NewConstant("test"), DecryptOptions{})
+	assert.NoError(t, err)
+}
+
+func TestEncryptDecryptDual(t *testing.T) {
+	armored, err := EncryptDual("first", "second", []byte("super secret"))
+	assert.NoError(t, err)
+
+	plaintext, err := DecryptDual("first", "second", armored)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("super secret"), plaintext)
+
+	_, err = DecryptDual("first", "wrong", armored)
+	assert.True(t, errors.Is(err, ErrDualOuterLayer))
+	assert.False(t, errors.Is(err, ErrDualInnerLayer))
+
+	_, err = DecryptDual("wrong", "second", armored)
+	assert.True(t, errors.Is(err, ErrDualInnerLayer))
+	assert.False(t, errors.Is(err, ErrDualOuterLayer))
+
+	// Order matters.
+	_, err = DecryptDual("second", "first", armored)
+	assert.Error(t, err)
+
+	// The second passphrase alone yields only the inner ciphertext, and the first alone nothing.
+	inner, err := decryptString("second", armored)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(inner), "super secret")
+	_, err = decryptString("first", armored)
+	assert.Error(t, err)
+
+	_, err = EncryptDual("same", "same", []byte("super secret"))
+	assert.Error(t, err)
+}
+
+func TestEncryptDecryptDualFile(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	mfs.files["plain"] = []byte("super secret")
+	err := EncryptDualFile("plain", "encrypted", preader.NewConstant("first"), preader.NewConstant("second"))
+	assert.NoError(t, err)
+
+	err = DecryptDualFile("encrypted", "newplain", preader.NewConstant("first"), preader.NewConstant("second"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("super secret"), mfs.files["newplain"])
+
+	err = DecryptDualFile("encrypted", "otherplain", preader.NewConstant("second"), preader.NewConstant("first"))
+	assert.Error(t, err)
+	assert.NotContains(t, mfs.files, "otherplain")
+
+	err = EncryptDualFile("plain", "same", preader.NewConstant("first"), preader.NewConstant("first"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "the two passphrases are the same")
+	assert.NotContains(t, mfs.files, "same")
+}
+
+func TestEncryptStdout(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	var out bytes.Buffer
+	oldStdout := stdout
+	stdout = &out
+	defer func() {
+		stdout = oldStdout
+	}()
+
+	mfs.files["plain"] = []byte("super secret")
+	err := Encrypt("plain", "", preader.NewConstant("test"), EncryptOptions{Stdout: true})
+	assert.NoError(t, err)
+	assert.Len(t, mfs.files, 1)
+
+	lines := strings.Split(out.String(), "\n")
+	assert.Len(t, lines, 2)
+	assert.Equal(t, "", lines[1])
+	assert.True(t, strings.HasPrefix(lines[0], "saltybox1:"))
+
+	plaintext, err := decryptString("test", lines[0])
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("super secret"), plaintext)
+
+	err = Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{Stdout: true})
+	assert.Error(t, err)
+	err = Encrypt("plain", "", preader.NewConstant("test"), EncryptOptions{Stdout: true, VerifyAfterWrite: true})
+	assert.Error(t, err)
+}
+
+func TestEstimateEntropyBits(t *testing.T) {
+	assert.Equal(t, 0.0, estimateEntropyBits(""))
+	assert.InDelta(t, 8*4.70, estimateEntropyBits("abcdefgh"), 0.01)
+	assert.InDelta(t, 8*5.70, estimateEntropyBits("abcdEFGH"), 0.01)
+	assert.InDelta(t, 4*math.Log2(95), estimateEntropyBits("aB3!"), 0.01)
+
+	// Longer is better given the same character classes.
+	assert.Greater(t, estimateEntropyBits("correct horse battery staple"), estimateEntropyBits("Tr0ub4dor&3"))
+}
+
+func TestPassphraseEntropy(t *testing.T) {
+	var out bytes.Buffer
+	err := PassphraseEntropy(preader.NewConstant("abcdefgh"), &out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "37.6 bits")
+	assert.NotContains(t, out.String(), "abcdefgh")
+}
+
+func TestImportRaw(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	raw, err := secretcrypt.Encrypt("test", []byte("super secret"))
+	assert.NoError(t, err)
+	mfs.files["raw"] = raw
+
+	err = Decrypt("raw", "rawplain", preader.NewConstant("test"), DecryptOptions{NoArmor: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("super secret"), mfs.files["rawplain"])
+
+	err = Decrypt("raw", "rawplain", preader.NewConstant("test"), DecryptOptions{NoArmor: true, Strict: true})
+	assert.Error(t, err)
+
+	err = ImportRaw("raw", "encrypted")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(mfs.files["encrypted"]), "saltybox1:"))
+
+	err = Decrypt("encrypted", "newplain", preader.NewConstant("test"), DecryptOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("super secret"), mfs.files["newplain"])
+
+	mfs.files["garbage"] = []byte("not secretcrypt")
+	err = ImportRaw("garbage", "garbage.salty")
+	assert.Error(t, err)
+	assert.NotContains(t, mfs.files, "garbage.salty")
+}
+
+func TestFormatLongDuration(t *testing.T) {
+	assert.Equal(t, "30 seconds", formatLongDuration(30))
+	assert.Equal(t, "2 minutes", formatLongDuration(120))
+	assert.Equal(t, "1.5 hours", formatLongDuration(5400))
+	assert.Equal(t, "2 days", formatLongDuration(2*24*60*60))
+	assert.Equal(t, "1e+06 years", formatLongDuration(1e6*365.25*24*60*60))
+}
+
+func TestCostEstimate(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	mfs.files["plain"] = []byte("super secret")
+	err := Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{})
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	err = CostEstimate("encrypted", 40, &out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "N=32768 r=8 p=1")
+	assert.Contains(t, out.String(), "expected guesses for a 40 bit passphrase: ~5.5e+11")
+	assert.Contains(t, out.String(), "rough estimate")
+
+	err = CostEstimate("encrypted", 0, &out)
+	assert.Error(t, err)
+	err = CostEstimate("plain", 40, &out)
+	assert.Error(t, err)
+}
+
+func TestDecryptExpectFormat(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	for name, plaintext := range map[string]string{
+		"json":   `{"env": "prod"}`,
+		"yaml":   "env: prod\nowner: team-x\n",
+		"binary": "\xff\xfe\x00",
+	} {
+		mfs.files[name] = []byte(plaintext)
+		err := Encrypt(name, name+".salty", preader.NewConstant("test"), EncryptOptions{})
+		assert.NoError(t, err)
+	}
+
+	err := Decrypt("json.salty", "out", preader.NewConstant("test"), DecryptOptions{ExpectFormat: "json"})
+	assert.NoError(t, err)
+	err = Decrypt("json.salty", "out", preader.NewConstant("test"), DecryptOptions{ExpectFormat: "yaml"})
+	assert.NoError(t, err)
+	err = Decrypt("yaml.salty", "out", preader.NewConstant("test"), DecryptOptions{ExpectFormat: "yaml"})
+	assert.NoError(t, err)
+	delete(mfs.files, "out")
+
+	err = Decrypt("yaml.salty", "out", preader.NewConstant("test"), DecryptOptions{ExpectFormat: "json"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not valid json")
+	assert.NotContains(t, mfs.files, "out")
+
+	err = Decrypt("binary.salty", "out", preader.NewConstant("test"), DecryptOptions{ExpectFormat: "yaml"})
+	assert.Error(t, err)
+	assert.NotContains(t, mfs.files, "out")
+
+	// Unsupported formats must be rejected before the passphrase is read.
+	pr := &countingPassphraseReader{passphrase: "test"}
+	err = Decrypt("json.salty", "out", pr, DecryptOptions{ExpectFormat: "xml"})
+	assert.Error(t, err)
+	assert.Equal(t, 0, pr.count)
+}
+
+func TestDecryptTryNewlineVariants(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	mfs.files["plain"] = []byte("super secret")
+	err := Encrypt("plain", "encrypted", preader.NewConstant("test\n"), EncryptOptions{})
+	assert.NoError(t, err)
+
+	err = Decrypt("encrypted", "newplain", preader.NewConstant("test"), DecryptOptions{})
+	assert.Error(t, err)
+
+	err = Decrypt("encrypted", "newplain", preader.NewConstant("test"), DecryptOptions{TryNewlineVariants: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("super secret"), mfs.files["newplain"])
+
+	err = Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{})
+	assert.NoError(t, err)
+	err = Decrypt("encrypted", "newplain2", preader.NewConstant("test \r\n"), DecryptOptions{TryNewlineVariants: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("super secret"), mfs.files["newplain2"])
+
+	err = Decrypt("encrypted", "newplain3", preader.NewConstant("wrong"), DecryptOptions{TryNewlineVariants: true})
+	assert.True(t, errors.Is(err, secretcrypt.ErrAuthentication), "%v", err)
+	assert.NotContains(t, mfs.files, "newplain3")
+
+	// Errors other than a wrong passphrase are reported as is, without trying variants.
+	mfs.files["corrupt"] = []byte("saltybox1:!!!")
+	err = Decrypt("corrupt", "newplain4", preader.NewConstant("test"), DecryptOptions{TryNewlineVariants: true})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to unarmor")
+	assert.NotContains(t, mfs.files, "newplain4")
+}
+
+func TestKDFProfile(t *testing.T) {
+	var out bytes.Buffer
+	err := KDFProfile([]int{1024, 2048}, &out)
+	assert.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 3)
+	assert.True(t, strings.HasPrefix(lines[1], "1024 "))
+	assert.Contains(t, lines[2], "2.0 MiB")
+
+	err = KDFProfile([]int{1000}, &out)
+	assert.Error(t, err)
+}
+
+func TestSignature(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	mfs.files["plain"] = []byte("super secret")
+	mfs.files["signkey"] = []byte("signing key")
+	mfs.files["otherkey"] = []byte("other key")
+	mfs.files["emptykey"] = []byte{}
+
+	err := Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{SignKeyFile: "signkey"})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(mfs.files["encrypted.sig"]), "saltybox-sig1:hmac-sha256:"))
+
+	err = VerifySignature("encrypted", "", "signkey")
+	assert.NoError(t, err)
+	err = VerifySignature("encrypted", "encrypted.sig", "signkey")
+	assert.NoError(t, err)
+
+	err = VerifySignature("encrypted", "", "otherkey")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "signature verification failed")
+
+	mfs.files["encrypted"] = append(mfs.files["encrypted"], '\n')
+	err = VerifySignature("encrypted", "", "signkey")
+	assert.Error(t, err)
+
+	mfs.files["encrypted.sig"] = []byte("nonsense")
+	err = VerifySignature("encrypted", "", "signkey")
+	assert.Error(t, err)
+
+	err = Encrypt("plain", "encrypted2", preader.NewConstant("test"), EncryptOptions{SignKeyFile: "emptykey"})
+	assert.Error(t, err)
+	assert.NotContains(t, mfs.files, "encrypted2")
+}
+
+func TestAgeRoundTrip(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	identity, err := age.GenerateX25519Identity()
+	assert.NoError(t, err)
+	mfs.files["identity"] = []byte("# test identity\n" + identity.String() + "\n")
+
+	mfs.files["plain"] = []byte("super secret")
+	err = Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{})
+	assert.NoError(t, err)
+
+	err = ToAge("encrypted", "encrypted.age", []string{identity.Recipient().String()}, preader.NewConstant("test"))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(mfs.files["encrypted.age"]), "super secret")
+
+	err = FromAge("encrypted.age", "reencrypted", "identity", preader.NewConstant("other"))
+	assert.NoError(t, err)
+
+	err = Decrypt("reencrypted", "newplain", preader.NewConstant("other"), DecryptOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("super secret"), mfs.files["newplain"])
+
+	// Armored age input.
+	var armored bytes.Buffer
+	aw := ageArmor.NewWriter(&armored)
+	w, err := age.Encrypt(aw, identity.Recipient())
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("armored secret"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assert.NoError(t, aw.Close())
+	mfs.files["armored.age"] = armored.Bytes()
+
+	err = FromAge("armored.age", "reencrypted2", "identity", preader.NewConstant("other"))
+	assert.NoError(t, err)
+	err = Decrypt("reencrypted2", "newplain2", preader.NewConstant("other"), DecryptOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("armored secret"), mfs.files["newplain2"])
+
+	err = ToAge("encrypted", "encrypted2.age", []string{"age1bogus"}, preader.NewConstant("test"))
+	assert.Error(t, err)
+	err = ToAge("encrypted", "encrypted2.age", nil, preader.NewConstant("test"))
+	assert.Error(t, err)
+	err = ToAge("encrypted", "encrypted2.age", []string{identity.Recipient().String()}, preader.NewConstant("wrong"))
+	assert.Error(t, err)
+	assert.NotContains(t, mfs.files, "encrypted2.age")
+}
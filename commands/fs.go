@@ -0,0 +1,82 @@
+package commands
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// fileSystem abstracts the filesystem operations performed by commands, so that tests can substitute an
+// implementation that simulates failures.
+type fileSystem interface {
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	Stat(name string) (os.FileInfo, error)
+	TempFile(dir string, pattern string) (tempFile, error)
+	TempDir(dir string, pattern string) (string, error)
+	CreateExclusive(name string, perm os.FileMode) (tempFile, error)
+	Rename(oldpath string, newpath string) error
+	Remove(name string) error
+	MkdirAll(path string, perm os.FileMode) error
+	ReadDir(dirname string) ([]os.FileInfo, error)
+	Chmod(name string, mode os.FileMode) error
+}
+
+// tempFile is the subset of *os.File used when writing to a tempfile.
+type tempFile interface {
+	io.Writer
+	Name() string
+	Sync() error
+	Close() error
+}
+
+// fsys is the fileSystem used by all commands. It is only ever replaced by tests.
+var fsys fileSystem = osFileSystem{}
+
+type osFileSystem struct{}
+
+func (osFileSystem) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+func (osFileSystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(name, data, perm)
+}
+
+func (osFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFileSystem) TempFile(dir string, pattern string) (tempFile, error) {
+	return ioutil.TempFile(dir, pattern)
+}
+
+func (osFileSystem) TempDir(dir string, pattern string) (string, error) {
+	return ioutil.TempDir(dir, pattern)
+}
+
+// CreateExclusive creates and opens name for writing, failing if it already exists or (where supported) is a
+// symlink.
+func (osFileSystem) CreateExclusive(name string, perm os.FileMode) (tempFile, error) {
+	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL|noFollow, perm)
+}
+
+func (osFileSystem) Rename(oldpath string, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFileSystem) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dirname)
+}
+
+func (osFileSystem) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
@@ -0,0 +1,760 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/scode/saltybox/preader"
+	"github.com/scode/saltybox/secretcrypt"
+	"github.com/scode/saltybox/varmor"
+	"github.com/stretchr/testify/assert"
+)
+
+// memFileSystem is an in-memory fileSystem which can be instructed to fail specific operations.
+type memFileSystem struct {
+	files     map[string][]byte
+	dirs      map[string]bool
+	tempCount int
+
+	renameErr error
+	writeErr  error
+
+	// renameErrs causes renames to specific target paths to fail with the given error.
+	renameErrs map[string]error
+
+	// shortWriteErr causes writes to tempfiles to write only half of the data before failing with this error.
+	shortWriteErr error
+
+	// corruptWrites causes WriteFile and tempfiles to silently corrupt a byte in the middle of the data written.
+	corruptWrites bool
+
+	// readOnly marks files and directories as not writable, as if by permissions.
+	readOnly map[string]bool
+
+	// modes are the permissions of files, where not the default of 0600 (or 0400 if readOnly).
+	modes map[string]os.FileMode
+
+	// mtimes are the modification times of files, where not the zero time.
+	mtimes map[string]time.Time
+}
+
+func newMemFileSystem() *memFileSystem {
+	return &memFileSystem{
+		files:    make(map[string][]byte),
+		dirs:     map[string]bool{".": true, "/": true},
+		readOnly: make(map[string]bool),
+		modes:    make(map[string]os.FileMode),
+		mtimes:   make(map[string]time.Time),
+	}
+}
+
+// useFileSystem replaces the fileSystem used by commands for the duration of the test.
+func useFileSystem(t *testing.T, fs fileSystem) {
+	previous := fsys
+	fsys = fs
+	t.Cleanup(func() {
+		fsys = previous
+	})
+}
+
+func (m *memFileSystem) ReadFile(name string) ([]byte, error) {
+	data, ok := m.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+
+	return append([]byte{}, data...), nil
+}
+
+func (m *memFileSystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	if m.writeErr != nil {
+		return m.writeErr
+	}
+	if _, exists := m.files[name]; m.readOnly[name] || (!exists && m.readOnly[filepath.Dir(name)]) {
+		return &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	m.files[name] = append([]byte{}, data...)
+	if m.corruptWrites && len(data) > 0 {
+		m.files[name][len(data)/2] ^= 0x20
+	}
+
+	return nil
+}
+
+func (m *memFileSystem) Stat(name string) (os.FileInfo, error) {
+	if m.dirs[name] {
+		return memFileInfo{name: name, dir: true}, nil
+	}
+
+	data, ok := m.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+
+	return memFileInfo{name: name, size: int64(len(data)), readOnly: m.readOnly[name], mode: m.modes[name],
+		mtime: m.mtimes[name]}, nil
+}
+
+func (m *memFileSystem) TempFile(dir string, pattern string) (tempFile, error) {
+	if m.readOnly[dir] {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrPermission}
+	}
+	m.tempCount++
+	name := fmt.Sprintf("%s%s%d", dir, pattern, m.tempCount)
+	m.files[name] = []byte{}
+
+	return &memTempFile{fs: m, name: name}, nil
+}
+
+func (m *memFileSystem) TempDir(dir string, pattern string) (string, error) {
+	if !m.dirs[dir] {
+		return "", &os.PathError{Op: "mkdir", Path: dir, Err: os.ErrNotExist}
+	}
+	m.tempCount++
+	name := filepath.Join(dir, fmt.Sprintf("%s%d", pattern, m.tempCount))
+	m.dirs[name] = true
+
+	return name, nil
+}
+
+func (m *memFileSystem) CreateExclusive(name string, perm os.FileMode) (tempFile, error) {
+	if _, ok := m.files[name]; ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+	if !m.dirs[filepath.Dir(name)] {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	m.files[name] = []byte{}
+
+	return &memTempFile{fs: m, name: name}, nil
+}
+
+func (m *memFileSystem) Rename(oldpath string, newpath string) error {
+	if m.renameErr != nil {
+		return m.renameErr
+	}
+	if err := m.renameErrs[newpath]; err != nil {
+		return err
+	}
+	data, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	m.files[newpath] = data
+	delete(m.files, oldpath)
+
+	return nil
+}
+
+func (m *memFileSystem) Remove(name string) error {
+	if _, ok := m.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(m.files, name)
+
+	return nil
+}
+
+func (m *memFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	for ; !m.dirs[path]; path = filepath.Dir(path) {
+		m.dirs[path] = true
+	}
+
+	return nil
+}
+
+func (m *memFileSystem) ReadDir(dirname string) ([]os.FileInfo, error) {
+	if !m.dirs[dirname] {
+		return nil, &os.PathError{Op: "open", Path: dirname, Err: os.ErrNotExist}
+	}
+
+	var infos []os.FileInfo
+	for name := range m.dirs {
+		if name != dirname && filepath.Dir(name) == dirname {
+			infos = append(infos, memFileInfo{name: filepath.Base(name), dir: true})
+		}
+	}
+	for name, data := range m.files {
+		if filepath.Dir(name) == dirname {
+			infos = append(infos, memFileInfo{name: filepath.Base(name), size: int64(len(data)), readOnly: m.readOnly[name], mode: m.modes[name]})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+
+	return infos, nil
+}
+
+func (m *memFileSystem) Chmod(name string, mode os.FileMode) error {
+	if _, ok := m.files[name]; !ok {
+		return &os.PathError{Op: "chmod", Path: name, Err: os.ErrNotExist}
+	}
+	m.modes[name] = mode
+
+	return nil
+}
+
+type memTempFile struct {
+	fs   *memFileSystem
+	name string
+	buf  bytes.Buffer
+}
+
+func (f *memTempFile) Write(p []byte) (int, error) {
+	if f.fs.writeErr != nil {
+		return 0, f.fs.writeErr
+	}
+	if f.fs.shortWriteErr != nil {
+		n, _ := f.buf.Write(p[:len(p)/2])
+		_ = f.Sync()
+		return n, f.fs.shortWriteErr
+	}
+
+	return f.buf.Write(p)
+}
+
+func (f *memTempFile) Name() string {
+	return f.name
+}
+
+func (f *memTempFile) Sync() error {
+	f.fs.files[f.name] = append([]byte{}, f.buf.Bytes()...)
+	if f.fs.corruptWrites && f.buf.Len() > 0 {
+		f.fs.files[f.name][f.buf.Len()/2] ^= 0x20
+	}
+	return nil
+}
+
+func (f *memTempFile) Close() error {
+	return f.Sync()
+}
+
+type memFileInfo struct {
+	name     string
+	size     int64
+	dir      bool
+	readOnly bool
+	mode     os.FileMode
+	mtime    time.Time
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) ModTime() time.Time { return i.mtime }
+func (i memFileInfo) IsDir() bool        { return i.dir }
+func (i memFileInfo) Sys() interface{}   { return nil }
+
+func (i memFileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0700
+	}
+	if i.mode != 0 {
+		return i.mode
+	}
+	if i.readOnly {
+		return 0400
+	}
+	return 0600
+}
+
+func TestUpdateRenameFailure(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	mfs.files["plain"] = []byte("super secret")
+	err := Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{})
+	assert.NoError(t, err)
+	original := mfs.files["encrypted"]
+
+	mfs.files["updatedplain"] = []byte("updated super secret")
+	mfs.renameErr = errors.New("simulated rename failure")
+
+	err = Update("updatedplain", "encrypted", preader.NewConstant("test"), UpdateOptions{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "simulated rename failure")
+
+	// The original file must be untouched, and the tempfile must have been cleaned up.
+	assert.Equal(t, original, mfs.files["encrypted"])
+	assert.Len(t, mfs.files, 3)
+	assert.Contains(t, mfs.files, "plain")
+	assert.Contains(t, mfs.files, "updatedplain")
+}
+
+func TestDecryptShortWrite(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	mfs.files["plain"] = []byte("super secret")
+	err := Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{})
+	assert.NoError(t, err)
+
+	mfs.shortWriteErr = errors.New("no space left on device")
+	err = Decrypt("encrypted", "newplain", preader.NewConstant("test"), DecryptOptions{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no space left on device")
+
+	// Neither a partial output nor the tempfile may remain.
+	assert.Len(t, mfs.files, 2)
+	assert.Contains(t, mfs.files, "plain")
+	assert.Contains(t, mfs.files, "encrypted")
+
+	// An existing output must be left untouched.
+	mfs.files["newplain"] = []byte("old")
+	err = Decrypt("encrypted", "newplain", preader.NewConstant("test"), DecryptOptions{})
+	assert.Error(t, err)
+	assert.Equal(t, []byte("old"), mfs.files["newplain"])
+}
+
+func TestEncryptAlsoOutputs(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	mfs.files["plain"] = []byte("super secret")
+	err := Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{
+		AlsoOutputs:      []string{"copy1", "copy2"},
+		VerifyAfterWrite: true,
+	})
+	assert.NoError(t, err)
+	assert.Len(t, mfs.files, 4)
+	assert.Equal(t, mfs.files["encrypted"], mfs.files["copy1"])
+	assert.Equal(t, mfs.files["encrypted"], mfs.files["copy2"])
+
+	// A failure writing the last output must remove all others, leaving no partial set.
+	mfs.renameErrs = map[string]error{"copy4": errors.New("simulated rename failure")}
+	err = Encrypt("plain", "encrypted2", preader.NewConstant("test"), EncryptOptions{
+		AlsoOutputs: []string{"copy3", "copy4"},
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "simulated rename failure")
+	assert.Len(t, mfs.files, 4)
+	assert.NotContains(t, mfs.files, "encrypted2")
+	assert.NotContains(t, mfs.files, "copy3")
+	assert.NotContains(t, mfs.files, "copy4")
+
+	// Existing files are never removed. The primary output is replaced last, so it is left as it was by a failure
+	// to replace any other output or signature.
+	mfs.files["signkey"] = []byte("signing key")
+	original := map[string][]byte{}
+	for name, data := range mfs.files {
+		original[name] = data
+	}
+	mfs.renameErrs = map[string]error{"copy1.sig": errors.New("simulated rename failure")}
+	err = Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{
+		AlsoOutputs: []string{"copy1"},
+		SignKeyFile: "signkey",
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no outputs were changed")
+	assert.Equal(t, original, mfs.files)
+
+	// Outputs which did not exist are removed again, while those already replaced are reported.
+	mfs.renameErrs = map[string]error{"encrypted": errors.New("simulated rename failure")}
+	err = Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{
+		AlsoOutputs: []string{"copy1", "copy6"},
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "already replaced: copy1")
+	assert.Equal(t, original["encrypted"], mfs.files["encrypted"])
+	assert.NotContains(t, mfs.files, "copy6")
+	assert.Len(t, mfs.files, len(original))
+	original["copy1"] = mfs.files["copy1"]
+
+	// A failure before any output is replaced, such as a failed verification, leaves no trace.
+	mfs.renameErrs = nil
+	mfs.corruptWrites = true
+	err = Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{
+		AlsoOutputs:      []string{"copy1", "copy5"},
+		VerifyAfterWrite: true,
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "verification failed")
+	assert.Equal(t, original, mfs.files)
+}
+
+func TestUpdateTargetChecks(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	mfs.files["plain"] = []byte("super secret")
+
+	pr := &countingPassphraseReader{passphrase: "test"}
+	err := Update("plain", "missing", pr, UpdateOptions{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "does not exist; use encrypt to create it")
+	assert.NotContains(t, mfs.files, "missing")
+
+	mfs.files["notsaltybox"] = []byte("just some text")
+	err = Update("plain", "notsaltybox", pr, UpdateOptions{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "is not a saltybox file")
+	assert.Equal(t, []byte("just some text"), mfs.files["notsaltybox"])
+
+	assert.Equal(t, 0, pr.count)
+}
+
+type sequencePassphraseReader struct {
+	passphrases []string
+	count       int
+}
+
+func (r *sequencePassphraseReader) ReadPassphrase() (string, error) {
+	passphrase := r.passphrases[r.count]
+	r.count++
+	return passphrase, nil
+}
+
+func TestUpdateRetries(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	mfs.files["plain"] = []byte("super secret")
+	err := Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{})
+	assert.NoError(t, err)
+	original := mfs.files["encrypted"]
+	mfs.files["updatedplain"] = []byte("updated super secret")
+
+	// Retries exhausted; the file must be untouched.
+	pr := &sequencePassphraseReader{passphrases: []string{"tset", "tsst", "test"}}
+	err = Update("updatedplain", "encrypted", pr, UpdateOptions{Retries: 1})
+	assert.Error(t, err)
+	assert.Equal(t, 2, pr.count)
+	assert.Equal(t, original, mfs.files["encrypted"])
+
+	// The passphrase read on the final retry is also the one used to encrypt.
+	pr = &sequencePassphraseReader{passphrases: []string{"tset", "tsst", "test"}}
+	err = Update("updatedplain", "encrypted", pr, UpdateOptions{Retries: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, pr.count)
+
+	err = Decrypt("encrypted", "newplain", preader.NewConstant("test"), DecryptOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("updated super secret"), mfs.files["newplain"])
+
+	// Errors other than a failure to authenticate are not retried.
+	mfs.files["encrypted"] = []byte("saltybox1:AAAA")
+	pr = &sequencePassphraseReader{passphrases: []string{"test", "test"}}
+	err = Update("updatedplain", "encrypted", pr, UpdateOptions{Retries: 1})
+	assert.Error(t, err)
+	assert.Equal(t, 1, pr.count)
+}
+
+func TestRewritesKeepArmorEncoding(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	mfs.files["plain"] = []byte("super secret")
+	mfs.files["updatedplain"] = []byte("updated super secret")
+	for _, encoding := range varmor.Encodings() {
+		err := Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{ArmorEncoding: encoding})
+		assert.NoError(t, err)
+
+		err = Update("updatedplain", "encrypted", preader.NewConstant("test"), UpdateOptions{})
+		assert.NoError(t, err)
+		updatedEncoding, _ := varmor.EncodingOf(string(mfs.files["encrypted"]))
+		assert.Equal(t, encoding, updatedEncoding)
+
+		err = Rekey("encrypted", preader.NewConstant("test"), preader.NewConstant("new"))
+		assert.NoError(t, err)
+		rekeyedEncoding, _ := varmor.EncodingOf(string(mfs.files["encrypted"]))
+		assert.Equal(t, encoding, rekeyedEncoding)
+
+		err = Decrypt("encrypted", "out", preader.NewConstant("new"), DecryptOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("updated super secret"), mfs.files["out"])
+	}
+}
+
+func TestUpdateDryRun(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	var out bytes.Buffer
+	oldStdout := stdout
+	stdout = &out
+	defer func() {
+		stdout = oldStdout
+	}()
+
+	mfs.files["plain"] = []byte("super secret")
+	err := Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{})
+	assert.NoError(t, err)
+	original := mfs.files["encrypted"]
+	tempCount := mfs.tempCount
+	mfs.files["updatedplain"] = []byte("updated super secret")
+
+	err = Update("updatedplain", "encrypted", preader.NewConstant("test"), UpdateOptions{DryRun: true})
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("passphrase: ok\nplain text changed: yes\nsize: %d bytes (currently %d bytes)\n",
+		varmor.WrappedLen(int(secretcrypt.CiphertextLen(int64(len("updated super secret"))))), len(original)), out.String())
+	assert.Equal(t, original, mfs.files["encrypted"])
+	assert.Equal(t, tempCount, mfs.tempCount)
+
+	out.Reset()
+	err = Update("plain", "encrypted", preader.NewConstant("test"), UpdateOptions{DryRun: true})
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "plain text changed: no\n")
+
+	// The passphrase is still validated.
+	out.Reset()
+	err = Update("updatedplain", "encrypted", preader.NewConstant("tset"), UpdateOptions{DryRun: true})
+	assert.Error(t, err)
+	assert.Equal(t, "", out.String())
+
+	// A dry run does not need to be able to write the target.
+	mfs.readOnly["encrypted"] = true
+	mfs.readOnly["."] = true
+	err = Update("updatedplain", "encrypted", preader.NewConstant("test"), UpdateOptions{DryRun: true})
+	assert.NoError(t, err)
+	err = Update("updatedplain", "encrypted", preader.NewConstant("test"), UpdateOptions{})
+	assert.Error(t, err)
+
+	// The size is computed without encrypting, and matches that of the real update in every armor encoding.
+	delete(mfs.readOnly, ".")
+	for _, encoding := range varmor.Encodings() {
+		err = Encrypt("plain", encoding, preader.NewConstant("test"), EncryptOptions{ArmorEncoding: encoding})
+		assert.NoError(t, err)
+		out.Reset()
+		err = Update("updatedplain", encoding, preader.NewConstant("test"), UpdateOptions{DryRun: true})
+		assert.NoError(t, err)
+		err = Update("updatedplain", encoding, preader.NewConstant("test"), UpdateOptions{})
+		assert.NoError(t, err)
+		assert.Contains(t, out.String(), fmt.Sprintf("size: %d bytes", len(mfs.files[encoding])), encoding)
+	}
+}
+
+func TestVerifyDir(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	assert.NoError(t, mfs.MkdirAll("backups/nested", 0700))
+	mfs.files["plain"] = []byte("super secret")
+	for _, path := range []string{"backups/a", "backups/nested/b"} {
+		err := Encrypt("plain", path, preader.NewConstant("test"), EncryptOptions{})
+		assert.NoError(t, err)
+	}
+	mfs.files["backups/notes.txt"] = []byte("not encrypted")
+
+	pr := &countingPassphraseReader{passphrase: "test"}
+	var out bytes.Buffer
+	err := VerifyDir("backups", pr, 2, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pr.count)
+	assert.Equal(t, "ok: backups/a\nok: backups/nested/b\n2 passed, 0 failed\n", out.String())
+
+	err = Encrypt("plain", "backups/nested/c", preader.NewConstant("other"), EncryptOptions{})
+	assert.NoError(t, err)
+	out.Reset()
+	err = VerifyDir("backups", pr, 2, &out)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "1 of 3 files failed")
+	assert.Contains(t, out.String(), "FAILED: backups/nested/c: ")
+	assert.Contains(t, out.String(), "2 passed, 1 failed\n")
+
+	// Directories without any saltybox files must not pass verification vacuously.
+	assert.NoError(t, mfs.MkdirAll("empty", 0700))
+	err = VerifyDir("empty", pr, 2, &out)
+	assert.Error(t, err)
+
+	err = VerifyDir("missing", pr, 2, &out)
+	assert.Error(t, err)
+	err = VerifyDir("backups", pr, 0, &out)
+	assert.Error(t, err)
+}
+
+func TestCommandError(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	mfs.files["plain"] = []byte("super secret")
+	err := Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{})
+	assert.NoError(t, err)
+
+	var cmdErr *CommandError
+
+	err = Decrypt("encrypted", "newplain", preader.NewConstant("wrong"), DecryptOptions{})
+	assert.True(t, errors.As(err, &cmdErr))
+	assert.Equal(t, "decrypt", cmdErr.Op)
+	assert.Equal(t, "encrypted", cmdErr.Path)
+	assert.True(t, errors.Is(err, secretcrypt.ErrAuthentication))
+	assert.Equal(t, "failed to decrypt encrypted: corrupt input, tampered-with data, or bad passphrase", err.Error())
+
+	err = Encrypt("missing", "encrypted", preader.NewConstant("test"), EncryptOptions{})
+	assert.True(t, errors.As(err, &cmdErr))
+	assert.Equal(t, "read from", cmdErr.Op)
+	assert.Equal(t, "missing", cmdErr.Path)
+	assert.True(t, os.IsNotExist(errors.Unwrap(err)))
+
+	mfs.renameErr = errors.New("simulated rename failure")
+	err = Update("plain", "encrypted", preader.NewConstant("test"), UpdateOptions{})
+	assert.True(t, errors.As(err, &cmdErr))
+	assert.Equal(t, "write to", cmdErr.Op)
+	assert.Equal(t, "encrypted", cmdErr.Path)
+
+	err = Decrypt("encrypted", "newplain", preader.NewConstant("test"), DecryptOptions{})
+	assert.True(t, errors.As(err, &cmdErr))
+	assert.Equal(t, "write to", cmdErr.Op)
+	assert.Equal(t, "newplain", cmdErr.Path)
+}
+
+func TestReadOnlyOutput(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	mfs.files["plain"] = []byte("super secret")
+	err := Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, mfs.MkdirAll("ro", 0700))
+	mfs.readOnly["ro"] = true
+	mfs.files["readonly"] = []byte("unchanged")
+	mfs.readOnly["readonly"] = true
+
+	// The passphrase must not be read (and no key derived) when the output cannot be written.
+	pr := &countingPassphraseReader{passphrase: "test"}
+	for _, err := range []error{
+		Encrypt("plain", "ro/encrypted", pr, EncryptOptions{}),
+		Encrypt("plain", "encrypted2", pr, EncryptOptions{AlsoOutputs: []string{"ro/encrypted"}}),
+		Decrypt("encrypted", "ro/plain", pr, DecryptOptions{}),
+	} {
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "permission denied (check file/directory permissions)")
+	}
+	assert.Equal(t, 0, pr.count)
+	assert.Equal(t, []byte("unchanged"), mfs.files["readonly"])
+
+	// A read-only file can be replaced atomically, since that only requires access to its directory.
+	err = Decrypt("encrypted", "readonly", pr, DecryptOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("super secret"), mfs.files["readonly"])
+	assert.Len(t, mfs.files, 3)
+	err = Encrypt("plain", "readonly", pr, EncryptOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, mfs.files, 3)
+}
+
+func TestRepair(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	mfs.files["plain"] = []byte("super secret")
+	err := Encrypt("plain", "encrypted", preader.NewConstant("test"), EncryptOptions{})
+	assert.NoError(t, err)
+	clean := mfs.files["encrypted"]
+	cipherBytes, err := varmor.Unwrap(string(clean))
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	for _, damaged := range []string{
+		string(clean) + "\n",
+		string(clean) + "\r\n\x00\x00\x00",
+		varmor.Wrap(append(append([]byte{}, cipherBytes...), 0, 0, 0, 0)),
+	} {
+		mfs.files["encrypted"] = []byte(damaged)
+		out.Reset()
+		err = Repair("encrypted", preader.NewConstant("test"), &out)
+		assert.NoError(t, err)
+		assert.Equal(t, clean, mfs.files["encrypted"])
+		assert.Contains(t, out.String(), "Removed")
+	}
+
+	// Nothing to do; the passphrase is not needed.
+	pr := &countingPassphraseReader{passphrase: "test"}
+	out.Reset()
+	err = Repair("encrypted", pr, &out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "nothing to repair")
+	assert.Equal(t, 0, pr.count)
+
+	// Too much junk, and junk which is repairable but with the wrong passphrase, must leave the file alone.
+	mfs.files["encrypted"] = []byte(string(clean) + strings.Repeat("\x00", maxRepairJunk+1))
+	err = Repair("encrypted", preader.NewConstant("test"), &out)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "likely corrupt")
+
+	mfs.files["encrypted"] = []byte(string(clean) + "\n")
+	err = Repair("encrypted", preader.NewConstant("wrong"), &out)
+	assert.Error(t, err)
+	assert.Equal(t, string(clean)+"\n", string(mfs.files["encrypted"]))
+
+	mfs.files["notsaltybox"] = []byte("plain text")
+	err = Repair("notsaltybox", preader.NewConstant("test"), &out)
+	assert.Error(t, err)
+}
+
+func TestAuditPerms(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	assert.NoError(t, mfs.MkdirAll("secrets/nested", 0700))
+	mfs.files["plain"] = []byte("super secret")
+	for _, path := range []string{"secrets/a", "secrets/nested/b", "secrets/nested/c"} {
+		err := Encrypt("plain", path, preader.NewConstant("test"), EncryptOptions{})
+		assert.NoError(t, err)
+	}
+	mfs.files["secrets/notes.txt"] = []byte("not encrypted")
+	mfs.modes["secrets/notes.txt"] = 0644
+	mfs.modes["secrets/nested/b"] = 0644
+	mfs.modes["secrets/nested/c"] = 0620
+
+	var out bytes.Buffer
+	err := AuditPerms("secrets", false, &out)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "2 saltybox files")
+	assert.Equal(t, "secrets/nested/b: -rw-r--r-- is accessible by group or others\n"+
+		"secrets/nested/c: -rw--w---- is accessible by group or others\n", out.String())
+	assert.Equal(t, os.FileMode(0644), mfs.modes["secrets/nested/b"])
+
+	out.Reset()
+	err = AuditPerms("secrets", true, &out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "secrets/nested/b: -rw-r--r-- is accessible by group or others; changed to -rw-------\n")
+	assert.Equal(t, os.FileMode(0600), mfs.modes["secrets/nested/b"])
+	assert.Equal(t, os.FileMode(0600), mfs.modes["secrets/nested/c"])
+	// Only saltybox files are audited.
+	assert.Equal(t, os.FileMode(0644), mfs.modes["secrets/notes.txt"])
+
+	out.Reset()
+	err = AuditPerms("secrets", false, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "", out.String())
+
+	err = AuditPerms("missing", false, &out)
+	assert.Error(t, err)
+}
+
+func TestDecryptMaxAge(t *testing.T) {
+	mfs := newMemFileSystem()
+	useFileSystem(t, mfs)
+
+	mfs.files["plain"] = []byte("super secret")
+	err := Encrypt("plain", "crypt", preader.NewConstant("test"), EncryptOptions{})
+	assert.NoError(t, err)
+
+	mfs.mtimes["crypt"] = time.Now().Add(-10 * 24 * time.Hour)
+	err = Decrypt("crypt", "out", preader.NewConstant("test"), DecryptOptions{MaxAge: "30d"})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("super secret"), mfs.files["out"])
+
+	// The check happens before the passphrase is read.
+	delete(mfs.files, "out")
+	mfs.mtimes["crypt"] = time.Now().Add(-100 * 24 * time.Hour)
+	pr := &countingPassphraseReader{passphrase: "test"}
+	err = Decrypt("crypt", "out", pr, DecryptOptions{MaxAge: "90d"})
+	assert.Error(t, err)
+	assert.Equal(t, 0, pr.count)
+	assert.Contains(t, err.Error(), "crypt was last modified 100 days ago, exceeding the maximum age of 90d")
+	assert.NotContains(t, mfs.files, "out")
+
+	err = Decrypt("crypt", "out", preader.NewConstant("test"), DecryptOptions{MaxAge: "soon"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid age")
+
+	err = Decrypt("https://example.com/crypt", "out", preader.NewConstant("test"), DecryptOptions{MaxAge: "90d"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "URL")
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package commands
+
+import "errors"
+
+// mmapFile maps the regular file at path read-only into memory. The returned unmap function must be called once
+// the data is no longer used, after which the data must not be accessed.
+func mmapFile(path string) (data []byte, unmap func() error, err error) {
+	return nil, nil, errors.New("memory mapping is only supported on Linux and macOS")
+}
@@ -0,0 +1,45 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the regular file at path read-only into memory. The returned unmap function must be called once
+// the data is no longer used, after which the data must not be accessed.
+func mmapFile(path string) (data []byte, unmap func() error, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, nil, errors.New("not a regular file")
+	}
+	// Mapping zero bytes is an error, and there would be nothing to gain anyway.
+	if info.Size() == 0 {
+		return nil, nil, errors.New("file is empty")
+	}
+	if int64(int(info.Size())) != info.Size() {
+		return nil, nil, errors.New("file too large to map")
+	}
+
+	data, err = syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, fmt.Errorf("mmap failed: %s", err)
+	}
+
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
@@ -0,0 +1,36 @@
+package commands
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+const (
+	tmpfsMagic = 0x01021994
+	ramfsMagic = 0x858458f6
+
+	// noFollow causes opening a path to fail if it is a symlink.
+	noFollow = syscall.O_NOFOLLOW
+)
+
+// secureTmpDir returns a RAM-backed directory suitable for briefly holding secrets, or an error if none is
+// available.
+func secureTmpDir() (string, error) {
+	candidates := []string{os.Getenv("XDG_RUNTIME_DIR"), "/dev/shm"}
+	for _, dir := range candidates {
+		if dir == "" {
+			continue
+		}
+
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(dir, &st); err != nil {
+			continue
+		}
+		if st.Type == tmpfsMagic || st.Type == ramfsMagic {
+			return dir, nil
+		}
+	}
+
+	return "", errors.New("no RAM-backed directory available (tried $XDG_RUNTIME_DIR and /dev/shm)")
+}
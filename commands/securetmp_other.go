@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package commands
+
+import "errors"
+
+// noFollow causes opening a path to fail if it is a symlink. Not supported on this platform.
+const noFollow = 0
+
+// secureTmpDir returns a RAM-backed directory suitable for briefly holding secrets, or an error if none is
+// available.
+func secureTmpDir() (string, error) {
+	return "", errors.New("RAM-backed output directories are only supported on Linux")
+}
@@ -3,8 +3,12 @@ module github.com/scode/saltybox
 go 1.14
 
 require (
+	filippo.io/age v1.0.0
+	github.com/atotto/clipboard v0.1.4
 	github.com/stretchr/testify v1.8.4
 	github.com/urfave/cli v1.22.14
 	golang.org/x/crypto v0.12.0
+	golang.org/x/sys v0.11.0
 	golang.org/x/term v0.11.0
+	gopkg.in/yaml.v3 v3.0.1
 )
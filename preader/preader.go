@@ -6,7 +6,16 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
+	"github.com/scode/saltybox/agent"
+	"github.com/scode/saltybox/shamir"
 	"golang.org/x/term"
 )
 
@@ -18,6 +27,18 @@ func NewTerminal() PassphraseReader {
 	return &terminalPassphraseReader{}
 }
 
+// NewTerminalWithTimeout is like NewTerminal, except that reading fails if no passphrase has been entered within
+// the given duration. The terminal state is restored when the timeout fires.
+func NewTerminalWithTimeout(timeout time.Duration) PassphraseReader {
+	return &terminalPassphraseReader{timeout: timeout}
+}
+
+// NewMaskedTerminal is like NewTerminal, except that a "*" is echoed for each character typed so that the user
+// gets feedback on their keystrokes. If timeout is non-zero, reading fails as with NewTerminalWithTimeout.
+func NewMaskedTerminal(timeout time.Duration) PassphraseReader {
+	return &terminalPassphraseReader{timeout: timeout, mask: true}
+}
+
 func NewCaching(upstream PassphraseReader) PassphraseReader {
 	return &cachingPassphraseReader{Upstream: upstream}
 }
@@ -26,6 +47,80 @@ func NewReader(reader io.Reader) PassphraseReader {
 	return &readerPassphraseReader{reader: reader}
 }
 
+// NewFD returns a PassphraseReader which reads the passphrase from the inherited file descriptor fd until EOF,
+// removing a single trailing newline ("\n" or "\r\n"). This allows passing a passphrase without it appearing in argv or the
+// environment (as with gpg --passphrase-fd). The file descriptor is closed after reading.
+func NewFD(fd int) PassphraseReader {
+	return &fdPassphraseReader{fd: fd}
+}
+
+// NewFile returns a PassphraseReader which uses the entire contents of the file at path (such as a keyfile) as
+// the passphrase. The contents is used as-is, without any trimming.
+func NewFile(path string) PassphraseReader {
+	return &filePassphraseReader{path: path}
+}
+
+// NewShares returns a PassphraseReader which reconstructs the passphrase from the armored Shamir shares (one per
+// line) in the file at path. See the shamir package.
+func NewShares(path string) PassphraseReader {
+	return &sharesPassphraseReader{path: path}
+}
+
+// NewCommand returns a PassphraseReader which runs the command described by argv and uses its stdout, with a
+// single trailing newline ("\n" or "\r\n") removed, as the passphrase. This allows integration with secret managers that print
+// secrets to stdout. Reading fails if the command exits with a non-zero status.
+func NewCommand(argv []string) PassphraseReader {
+	return &commandPassphraseReader{argv: argv}
+}
+
+// NewSystemdCredential returns a PassphraseReader which uses the entire contents of the systemd credential with
+// the given name (see LoadCredential= in systemd.exec(5)) as the passphrase. The credential is read from
+// $CREDENTIALS_DIRECTORY/<name>; reading fails if $CREDENTIALS_DIRECTORY is not set or the file is absent.
+func NewSystemdCredential(name string) PassphraseReader {
+	return &systemdCredentialPassphraseReader{name: name}
+}
+
+// NewAgent returns a PassphraseReader which uses the passphrase cached by the agent listening at socketPath (see
+// the agent package), if any. Otherwise the passphrase is read from upstream and stored in the agent for
+// subsequent use. If the agent cannot be reached, a warning is printed and upstream is used directly.
+func NewAgent(socketPath string, upstream PassphraseReader) PassphraseReader {
+	return &agentPassphraseReader{socketPath: socketPath, upstream: upstream}
+}
+
+// TrimPolicy describes how NewTrimming normalizes surrounding whitespace of a passphrase.
+type TrimPolicy int
+
+const (
+	// TrimNone leaves the passphrase as-is.
+	TrimNone TrimPolicy = iota
+	// TrimTrailingNewline removes a single trailing newline ("\n" or "\r\n").
+	TrimTrailingNewline
+	// TrimAllSurrounding removes all leading and trailing whitespace.
+	TrimAllSurrounding
+)
+
+var trimPolicyNames = map[string]TrimPolicy{
+	"none":             TrimNone,
+	"trailing-newline": TrimTrailingNewline,
+	"all-surrounding":  TrimAllSurrounding,
+}
+
+// ParseTrimPolicy returns the TrimPolicy with the given name: "none", "trailing-newline" or "all-surrounding".
+func ParseTrimPolicy(name string) (TrimPolicy, error) {
+	policy, ok := trimPolicyNames[name]
+	if !ok {
+		return TrimNone, fmt.Errorf("unsupported trim policy %q; supported policies are none, trailing-newline and all-surrounding", name)
+	}
+
+	return policy, nil
+}
+
+// NewTrimming returns a PassphraseReader which normalizes the passphrase read from upstream according to policy.
+// This is applied on top of any normalization performed by upstream itself.
+func NewTrimming(upstream PassphraseReader, policy TrimPolicy) PassphraseReader {
+	return &trimmingPassphraseReader{upstream: upstream, policy: policy}
+}
+
 func NewConstant(passphrase string) PassphraseReader {
 	return &constantPassphraseReader{passphrase: passphrase}
 }
@@ -38,7 +133,10 @@ func (r *constantPassphraseReader) ReadPassphrase() (string, error) {
 	return r.passphrase, nil
 }
 
-type terminalPassphraseReader struct{}
+type terminalPassphraseReader struct {
+	timeout time.Duration
+	mask    bool
+}
 
 func (r *terminalPassphraseReader) ReadPassphrase() (string, error) {
 	if !term.IsTerminal(0) {
@@ -49,7 +147,21 @@ func (r *terminalPassphraseReader) ReadPassphrase() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	phrase, err := term.ReadPassword(0)
+
+	if !r.mask && r.timeout == 0 {
+		phrase, err := term.ReadPassword(0)
+		if err != nil {
+			return "", fmt.Errorf("failure reading passphrase: %s", err)
+		}
+
+		return string(phrase), nil
+	}
+
+	var echo io.Writer = ioutil.Discard
+	if r.mask {
+		echo = os.Stderr
+	}
+	phrase, err := readRawPassword(echo, r.timeout)
 	if err != nil {
 		return "", fmt.Errorf("failure reading passphrase: %s", err)
 	}
@@ -57,6 +169,135 @@ func (r *terminalPassphraseReader) ReadPassphrase() (string, error) {
 	return string(phrase), nil
 }
 
+// readRawPassword reads a passphrase from stdin, which must be a terminal, using readMasked with the terminal in
+// raw mode. The terminal is restored before returning.
+//
+// Reading fails if timeout is non-zero and no passphrase has been entered within it, or if the process receives
+// a signal while reading, so that the caller can clean up and fail as usual. Where the platform allows it (see
+// newStoppableReader), the background read is stopped before returning so that it does not consume input meant
+// for a later read; elsewhere it is abandoned.
+func readRawPassword(echo io.Writer, timeout time.Duration) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer func() {
+		signal.Stop(signals)
+		_ = term.Restore(fd, state)
+		_, _ = fmt.Fprintln(os.Stderr)
+	}()
+
+	var timedOut <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timedOut = timer.C
+	}
+
+	type result struct {
+		phrase []byte
+		err    error
+	}
+	results := make(chan result, 1)
+	stop := make(chan struct{})
+	go func() {
+		phrase, err := readMasked(newStoppableReader(os.Stdin, stop), echo)
+		results <- result{phrase: phrase, err: err}
+	}()
+
+	select {
+	case res := <-results:
+		return res.phrase, res.err
+	case sig := <-signals:
+		err = fmt.Errorf("%s (%s)", errInterrupted, sig)
+	case <-timedOut:
+		err = fmt.Errorf("timed out after %s waiting for passphrase", timeout)
+	}
+
+	close(stop)
+	if readsStoppable {
+		<-results
+	}
+
+	return nil, err
+}
+
+// errInterrupted is returned by readMasked if the user presses Ctrl-C, which does not generate a signal while
+// the terminal is in raw mode.
+var errInterrupted = errors.New("interrupted")
+
+// errStopped is returned by readers from newStoppableReader once they have been asked to stop.
+var errStopped = errors.New("read stopped")
+
+// readMasked reads a line of keystrokes from a terminal in raw mode, writing a "*" to echo for each character
+// (rather than byte) read. Backspace erases the last character, Ctrl-U erases everything and Ctrl-C aborts.
+// Other control characters, and escape sequences (such as those sent by arrow keys), are ignored.
+func readMasked(r io.Reader, echo io.Writer) ([]byte, error) {
+	var phrase []byte
+	buf := make([]byte, 1)
+	// Escape sequences are of the form ESC [ ... final or ESC O final, with a final byte in the range @ to ~.
+	inEscape, inSequence := false, false
+	for {
+		n, err := r.Read(buf)
+		if n == 0 {
+			if err == io.EOF {
+				return phrase, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		c := buf[0]
+		if inEscape {
+			inEscape = false
+			inSequence = c == '[' || c == 'O'
+			continue
+		}
+		if inSequence {
+			inSequence = c < '@' || c > '~'
+			continue
+		}
+
+		switch {
+		case c == '\r' || c == '\n':
+			return phrase, nil
+		case c == 3:
+			return nil, errInterrupted
+		case c == 127 || c == '\b':
+			if len(phrase) > 0 {
+				_, size := utf8.DecodeLastRune(phrase)
+				phrase = phrase[:len(phrase)-size]
+				if _, err := io.WriteString(echo, "\b \b"); err != nil {
+					return nil, err
+				}
+			}
+		case c == 27:
+			inEscape = true
+		case c == 21:
+			if _, err := io.WriteString(echo, strings.Repeat("\b \b", utf8.RuneCount(phrase))); err != nil {
+				return nil, err
+			}
+			phrase = phrase[:0]
+		case c < 32:
+		default:
+			phrase = append(phrase, c)
+			// Continuation bytes of a multi-byte character do not get their own mask.
+			if !utf8.RuneStart(c) {
+				continue
+			}
+			if _, err := io.WriteString(echo, "*"); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
 // cachingPassphraseReader will wrap a PassphraseReader by adding caching.
 //
 // This is useful to allow "at most once" semantics when reading the passphrase, while
@@ -92,3 +333,166 @@ func (r *readerPassphraseReader) ReadPassphrase() (string, error) {
 
 	return string(data), nil
 }
+
+type fdPassphraseReader struct {
+	fd int
+}
+
+func (r *fdPassphraseReader) ReadPassphrase() (string, error) {
+	if r.fd < 0 {
+		return "", fmt.Errorf("invalid file descriptor %d", r.fd)
+	}
+
+	f := os.NewFile(uintptr(r.fd), fmt.Sprintf("fd %d", r.fd))
+	if f == nil {
+		return "", fmt.Errorf("invalid file descriptor %d", r.fd)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", fmt.Errorf("error reading passphrase from file descriptor %d: %v", r.fd, err)
+	}
+
+	return trimTrailingNewline(string(data)), nil
+}
+
+type filePassphraseReader struct {
+	path string
+}
+
+func (r *filePassphraseReader) ReadPassphrase() (string, error) {
+	data, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return "", fmt.Errorf("error reading passphrase from %s: %v", r.path, err)
+	}
+
+	return string(data), nil
+}
+
+type sharesPassphraseReader struct {
+	path string
+}
+
+func (r *sharesPassphraseReader) ReadPassphrase() (string, error) {
+	data, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return "", fmt.Errorf("error reading shares from %s: %v", r.path, err)
+	}
+
+	var shares [][]byte
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		share, err := shamir.UnarmorShare(line)
+		if err != nil {
+			return "", fmt.Errorf("invalid share in %s: %v", r.path, err)
+		}
+		shares = append(shares, share)
+	}
+
+	passphrase, err := shamir.Combine(shares)
+	if err != nil {
+		return "", fmt.Errorf("failed to combine shares: %v", err)
+	}
+
+	return string(passphrase), nil
+}
+
+type commandPassphraseReader struct {
+	argv []string
+}
+
+func (r *commandPassphraseReader) ReadPassphrase() (string, error) {
+	if len(r.argv) == 0 {
+		return "", errors.New("no passphrase command specified")
+	}
+
+	cmd := exec.Command(r.argv[0], r.argv[1:]...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("passphrase command %s failed: %v", r.argv[0], err)
+	}
+
+	return trimTrailingNewline(string(out)), nil
+}
+
+type systemdCredentialPassphraseReader struct {
+	name string
+}
+
+func (r *systemdCredentialPassphraseReader) ReadPassphrase() (string, error) {
+	if r.name == "" || strings.ContainsRune(r.name, '/') {
+		return "", fmt.Errorf("invalid credential name %q", r.name)
+	}
+
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return "", errors.New("cannot read passphrase from systemd credential - $CREDENTIALS_DIRECTORY is not set")
+	}
+
+	return (&filePassphraseReader{path: filepath.Join(dir, r.name)}).ReadPassphrase()
+}
+
+type agentPassphraseReader struct {
+	socketPath string
+	upstream   PassphraseReader
+}
+
+func (r *agentPassphraseReader) ReadPassphrase() (string, error) {
+	phrase, ok, err := agent.Get(r.socketPath)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "warning: not using passphrase agent: %v\n", err)
+		return r.upstream.ReadPassphrase()
+	}
+	if ok {
+		return phrase, nil
+	}
+
+	phrase, err = r.upstream.ReadPassphrase()
+	if err != nil {
+		return "", err
+	}
+	if err = agent.Put(r.socketPath, phrase); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "warning: failed to store passphrase in agent: %v\n", err)
+	}
+
+	return phrase, nil
+}
+
+// trimTrailingNewline removes a single trailing newline ("\n" or "\r\n") from s. A lone trailing "\r" is
+// left alone, since it may be part of the passphrase.
+func trimTrailingNewline(s string) string {
+	if strings.HasSuffix(s, "\r\n") {
+		return strings.TrimSuffix(s, "\r\n")
+	}
+
+	return strings.TrimSuffix(s, "\n")
+}
+
+type trimmingPassphraseReader struct {
+	upstream PassphraseReader
+	policy   TrimPolicy
+}
+
+func (r *trimmingPassphraseReader) ReadPassphrase() (string, error) {
+	phrase, err := r.upstream.ReadPassphrase()
+	if err != nil {
+		return "", err
+	}
+
+	switch r.policy {
+	case TrimTrailingNewline:
+		phrase = trimTrailingNewline(phrase)
+	case TrimAllSurrounding:
+		phrase = strings.TrimSpace(phrase)
+	}
+
+	return phrase, nil
+}
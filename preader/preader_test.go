@@ -1,10 +1,17 @@
 package preader
 
 import (
+	"bytes"
 	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/scode/saltybox/agent"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -64,3 +71,259 @@ func TestCachingPassphraseReader_ReadPassphrase(t *testing.T) {
 	assert.Equal(t, "phrase", phrase)
 	assert.Equal(t, 1, upstream.callCount)
 }
+
+func TestFileReader(t *testing.T) {
+	f, err := ioutil.TempFile("", "saltyboxtest")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.Remove(f.Name()))
+	}()
+	_, err = f.Write([]byte("key\x00bytes\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	pf, err := NewFile(f.Name()).ReadPassphrase()
+	assert.NoError(t, err)
+	assert.Equal(t, "key\x00bytes\n", pf)
+
+	_, err = NewFile(f.Name() + "-nonexistent").ReadPassphrase()
+	assert.Error(t, err)
+}
+
+func TestFDReader(t *testing.T) {
+	cases := map[string]string{
+		"passphrase\n":   "passphrase",
+		"passphrase\r\n": "passphrase",
+		"passphrase\r":   "passphrase\r",
+		"passphrase\n\n": "passphrase\n",
+	}
+	for input, expected := range cases {
+		r, w, err := os.Pipe()
+		assert.NoError(t, err)
+
+		_, err = w.WriteString(input)
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+
+		pf, err := NewFD(int(r.Fd())).ReadPassphrase()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, pf, "%q", input)
+	}
+
+	_, err := NewFD(-1).ReadPassphrase()
+	assert.Error(t, err)
+}
+
+func TestCommandReader(t *testing.T) {
+	pf, err := NewCommand([]string{"echo", "passphrase"}).ReadPassphrase()
+	assert.NoError(t, err)
+	assert.Equal(t, "passphrase", pf)
+
+	// Only a single trailing newline is removed.
+	pf, err = NewCommand([]string{"printf", "passphrase\n\n"}).ReadPassphrase()
+	assert.NoError(t, err)
+	assert.Equal(t, "passphrase\n", pf)
+
+	pf, err = NewCommand([]string{"printf", "passphrase\r\n"}).ReadPassphrase()
+	assert.NoError(t, err)
+	assert.Equal(t, "passphrase", pf)
+
+	// A carriage return without a newline is part of the passphrase.
+	pf, err = NewCommand([]string{"printf", "passphrase\r"}).ReadPassphrase()
+	assert.NoError(t, err)
+	assert.Equal(t, "passphrase\r", pf)
+
+	_, err = NewCommand([]string{"false"}).ReadPassphrase()
+	assert.Error(t, err)
+
+	_, err = NewCommand([]string{}).ReadPassphrase()
+	assert.Error(t, err)
+}
+
+func TestSystemdCredentialReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "saltyboxtest")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+
+	err = ioutil.WriteFile(filepath.Join(dir, "passphrase"), []byte("passphrase"), 0600)
+	assert.NoError(t, err)
+
+	oldDir, wasSet := os.LookupEnv("CREDENTIALS_DIRECTORY")
+	defer func() {
+		if wasSet {
+			assert.NoError(t, os.Setenv("CREDENTIALS_DIRECTORY", oldDir))
+		} else {
+			assert.NoError(t, os.Unsetenv("CREDENTIALS_DIRECTORY"))
+		}
+	}()
+
+	assert.NoError(t, os.Unsetenv("CREDENTIALS_DIRECTORY"))
+	_, err = NewSystemdCredential("passphrase").ReadPassphrase()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "CREDENTIALS_DIRECTORY")
+
+	assert.NoError(t, os.Setenv("CREDENTIALS_DIRECTORY", dir))
+	pf, err := NewSystemdCredential("passphrase").ReadPassphrase()
+	assert.NoError(t, err)
+	assert.Equal(t, "passphrase", pf)
+
+	_, err = NewSystemdCredential("missing").ReadPassphrase()
+	assert.Error(t, err)
+
+	_, err = NewSystemdCredential("../passphrase").ReadPassphrase()
+	assert.Error(t, err)
+}
+
+func TestAgentReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "saltyboxtest")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+
+	socketPath := filepath.Join(dir, "agent.sock")
+	l, err := agent.Listen(socketPath)
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, l.Close())
+	}()
+	go func() {
+		_ = agent.Serve(l, time.Hour)
+	}()
+
+	// The first read must penetrate to upstream, and the second be served by the agent.
+	upstream := mockPassphraseReader{constantPassphrase: "phrase"}
+	pf, err := NewAgent(socketPath, &upstream).ReadPassphrase()
+	assert.NoError(t, err)
+	assert.Equal(t, "phrase", pf)
+	assert.Equal(t, 1, upstream.callCount)
+
+	pf, err = NewAgent(socketPath, &upstream).ReadPassphrase()
+	assert.NoError(t, err)
+	assert.Equal(t, "phrase", pf)
+	assert.Equal(t, 1, upstream.callCount)
+
+	// An unreachable agent falls back to upstream.
+	pf, err = NewAgent(filepath.Join(dir, "missing.sock"), &upstream).ReadPassphrase()
+	assert.NoError(t, err)
+	assert.Equal(t, "phrase", pf)
+	assert.Equal(t, 2, upstream.callCount)
+}
+
+// oneByteReader returns the bytes of data one at a time, as a terminal in raw mode would.
+type oneByteReader struct {
+	data []byte
+}
+
+func (r *oneByteReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	p[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
+
+func TestReadMasked(t *testing.T) {
+	tests := []struct {
+		input  string
+		phrase string
+		echo   string
+	}{
+		{"pass\r", "pass", "****"},
+		{"pass\nignored", "pass", "****"},
+		{"pasz\x7fs\r", "pass", "****\b \b*"},
+		{"\x7f\bpass\r", "pass", "****"},
+		{"wrong\x15pass\r", "pass", "*****\b \b\b \b\b \b\b \b\b \b****"},
+		// Multi-byte characters are masked, and erased, as a single character.
+		{"p\xc3\xa4ss\x7f\x7f\r", "p\xc3\xa4", "****\b \b\b \b"},
+		// Control characters and escape sequences, such as those sent by arrow keys, are ignored.
+		{"pa\x01ss\r", "pass", "****"},
+		{"pa\x1b[Ds\x1bOCs\x1b[3~\r", "pass", "****"},
+		{"pass", "pass", "****"},
+	}
+	for _, test := range tests {
+		var echo bytes.Buffer
+		phrase, err := readMasked(&oneByteReader{data: []byte(test.input)}, &echo)
+		assert.NoError(t, err)
+		assert.Equal(t, test.phrase, string(phrase), "input %q", test.input)
+		assert.Equal(t, test.echo, echo.String(), "input %q", test.input)
+	}
+
+	_, err := readMasked(&oneByteReader{data: []byte("pa\x03ss\r")}, ioutil.Discard)
+	assert.Equal(t, errInterrupted, err)
+
+	_, err = readMasked(&erroringReader{}, ioutil.Discard)
+	assert.Error(t, err)
+}
+
+func TestStoppableReader(t *testing.T) {
+	if !readsStoppable {
+		t.Skip("reads cannot be stopped on this platform")
+	}
+
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	defer r.Close()
+	defer w.Close()
+
+	stop := make(chan struct{})
+	sr := newStoppableReader(r, stop)
+	_, err = w.Write([]byte("a"))
+	assert.NoError(t, err)
+	buf := make([]byte, 1)
+	n, err := sr.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(buf[:n]))
+
+	// A read blocked waiting for input returns once stopped, without consuming input written afterwards.
+	errs := make(chan error, 1)
+	go func() {
+		_, err := sr.Read(buf)
+		errs <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	select {
+	case err = <-errs:
+		assert.Equal(t, errStopped, err)
+	case <-time.After(time.Second):
+		t.Fatal("read was not stopped")
+	}
+
+	_, err = w.Write([]byte("b"))
+	assert.NoError(t, err)
+	n, err = r.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", string(buf[:n]))
+}
+
+func TestTrimmingReader(t *testing.T) {
+	tests := []struct {
+		policy   string
+		input    string
+		expected string
+	}{
+		{"none", " pass phrase \r\n", " pass phrase \r\n"},
+		{"trailing-newline", " pass phrase \r\n", " pass phrase "},
+		{"trailing-newline", "pass phrase\n\n", "pass phrase\n"},
+		{"trailing-newline", "pass phrase\r", "pass phrase\r"},
+		{"all-surrounding", "\t pass phrase \r\n", "pass phrase"},
+	}
+	for _, test := range tests {
+		policy, err := ParseTrimPolicy(test.policy)
+		assert.NoError(t, err)
+
+		pf, err := NewTrimming(NewConstant(test.input), policy).ReadPassphrase()
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, pf, "policy %s, input %q", test.policy, test.input)
+	}
+
+	_, err := ParseTrimPolicy("trailing")
+	assert.Error(t, err)
+
+	_, err = NewTrimming(NewReader(&erroringReader{}), TrimAllSurrounding).ReadPassphrase()
+	assert.Error(t, err)
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package preader
+
+import (
+	"io"
+	"os"
+)
+
+// readsStoppable is whether readers returned by newStoppableReader stop reading once asked to.
+const readsStoppable = false
+
+// newStoppableReader returns f itself, since there is no portable way to stop a blocked read on this platform.
+func newStoppableReader(f *os.File, stop <-chan struct{}) io.Reader {
+	return f
+}
@@ -0,0 +1,56 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package preader
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// readsStoppable is whether readers returned by newStoppableReader stop reading once asked to.
+const readsStoppable = true
+
+// stopPollInterval is how often a stoppableReader waiting for input checks whether it has been asked to stop.
+const stopPollInterval = 100 * time.Millisecond
+
+// stoppableReader reads from a file, but fails with errStopped instead of reading any further once stop is
+// closed. It waits for input with select and a timeout, so that it is never blocked in a read when asked to stop.
+type stoppableReader struct {
+	f    *os.File
+	fd   int
+	stop <-chan struct{}
+}
+
+// newStoppableReader returns a reader of f which stops reading once stop is closed. It does not take ownership
+// of f.
+func newStoppableReader(f *os.File, stop <-chan struct{}) io.Reader {
+	return &stoppableReader{f: f, fd: int(f.Fd()), stop: stop}
+}
+
+func (r *stoppableReader) Read(p []byte) (int, error) {
+	for {
+		select {
+		case <-r.stop:
+			return 0, errStopped
+		default:
+		}
+
+		var fds unix.FdSet
+		fds.Set(r.fd)
+		timeout := unix.NsecToTimeval(stopPollInterval.Nanoseconds())
+		n, err := unix.Select(r.fd+1, &fds, nil, nil, &timeout)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if n > 0 {
+			return r.f.Read(p)
+		}
+	}
+}
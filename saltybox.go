@@ -2,11 +2,17 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"os"
+	"runtime"
+	"strings"
+	"time"
 
+	"github.com/scode/saltybox/agent"
 	"github.com/scode/saltybox/commands"
 	"github.com/scode/saltybox/preader"
+	"github.com/scode/saltybox/varmor"
 
 	"github.com/urfave/cli"
 )
@@ -19,16 +25,115 @@ func main() {
 	app.HideVersion = true
 
 	var passphraseStdinArg bool
-	getPassphraseReader := func() preader.PassphraseReader {
+	var passphraseFDArg int
+	var passphraseCmdArg string
+	var passphraseCredentialArg string
+	var promptTimeoutArg time.Duration
+	var secretKeyfileArg string
+	var agentArg bool
+	var maskArg bool
+	var passphraseTrimArg string
+	var trimPolicy preader.TrimPolicy
+	getUntrimmedPassphraseReader := func() preader.PassphraseReader {
 		if passphraseStdinArg {
 			return preader.NewReader(os.Stdin)
 		}
+		if passphraseFDArg >= 0 {
+			return preader.NewFD(passphraseFDArg)
+		}
+		if passphraseCmdArg != "" {
+			return preader.NewCommand(strings.Fields(passphraseCmdArg))
+		}
+		if passphraseCredentialArg != "" {
+			return preader.NewSystemdCredential(passphraseCredentialArg)
+		}
 
-		return preader.NewTerminal()
+		terminal := preader.NewTerminal()
+		if maskArg {
+			terminal = preader.NewMaskedTerminal(promptTimeoutArg)
+		} else if promptTimeoutArg > 0 {
+			terminal = preader.NewTerminalWithTimeout(promptTimeoutArg)
+		}
+		if agentArg {
+			// Only prompted passphrases are cached; other sources are cheap to read again.
+			return preader.NewAgent(os.Getenv(agent.SocketEnv), terminal)
+		}
+
+		return terminal
+	}
+	getPassphraseReader := func() preader.PassphraseReader {
+		// Keyfiles hold random bytes which are used as-is; trimming them would change the secret.
+		if secretKeyfileArg != "" {
+			return preader.NewFile(secretKeyfileArg)
+		}
+		return preader.NewTrimming(getUntrimmedPassphraseReader(), trimPolicy)
+	}
+	// promptsForPassphrase returns whether getPassphraseReader reads a fresh passphrase from the terminal on
+	// each read, making it meaningful to ask again after a typo.
+	promptsForPassphrase := func() bool {
+		return secretKeyfileArg == "" && !passphraseStdinArg && passphraseFDArg < 0 && passphraseCmdArg == "" &&
+			passphraseCredentialArg == "" && !agentArg
+	}
+	// checkDualPassphraseSource returns an error unless two independent passphrases can be read, which requires
+	// prompting for each. Other sources would yield the same secret twice, or fail on the second read.
+	checkDualPassphraseSource := func() error {
+		if !promptsForPassphrase() {
+			return errors.New("both passphrases must be entered at the terminal; --passphrase-stdin, --passphrase-fd, " +
+				"--passphrase-cmd, --passphrase-credential, --keyfile and --agent cannot supply two independent passphrases")
+		}
+		return nil
 	}
 
 	var inputArg string
 	var outputArg string
+	var estimateArg bool
+	var wordlistArg string
+	var parallelismArg int
+	var coverArg string
+	var keyfileArg string
+	var secureTmpArg bool
+	var maxAgeArg string
+	var sharesArg int
+	var thresholdArg int
+	var sharesFileArg string
+	var fieldsArg string
+	var mkdirArg bool
+	var headerArg string
+	var bodyArg string
+	var verifyAfterWriteArg bool
+	var onlyIfChangedArg bool
+	var retriesArg int
+	var dryRunArg bool
+	var mmapArg bool
+	var fromClipboardArg bool
+	var toClipboardArg bool
+	var pemArg bool
+	var rawBoxEncodingArg string
+	var dirArg string
+	var fixArg bool
+	var fromEncodingArg string
+	var toEncodingArg string
+	var headersArg cli.StringSlice
+	var caArg string
+	var armorEncodingArg string
+	var bytesArg int
+	var forceArg bool
+	var sizeArg string
+	var noEmptyPassphraseArg bool
+	var strictArg bool
+	var stdoutArg bool
+	var socketArg string
+	var ttlArg time.Duration
+	var noArmorArg bool
+	var entropyBitsArg float64
+	var alsoOutputsArg cli.StringSlice
+	var expectFormatArg string
+	var tryNewlineVariantsArg bool
+	var kdfNsArg cli.IntSlice
+	var signKeyArg string
+	var sigArg string
+	var recipientsArg cli.StringSlice
+	var identityArg string
 
 	app.Flags = []cli.Flag{
 		cli.BoolFlag{
@@ -36,6 +141,49 @@ func main() {
 			Usage:       "Read passphrase from stdin instead of from terminal",
 			Destination: &passphraseStdinArg,
 		},
+		cli.IntFlag{
+			Name:        "passphrase-fd",
+			Usage:       "Read passphrase from this inherited file descriptor (a single trailing newline is removed)",
+			Value:       -1,
+			Destination: &passphraseFDArg,
+		},
+		cli.StringFlag{
+			Name:        "passphrase-cmd",
+			Usage:       "Run this command (arguments separated by whitespace, no shell quoting) and use its output as the passphrase",
+			Destination: &passphraseCmdArg,
+		},
+		cli.StringFlag{
+			Name:        "passphrase-credential",
+			Usage:       "Read passphrase from the systemd credential with this name (see LoadCredential= in systemd.exec(5))",
+			Destination: &passphraseCredentialArg,
+		},
+		cli.DurationFlag{
+			Name:        "prompt-timeout",
+			Usage:       "Give up if no passphrase has been entered at the terminal within this duration (e.g. 30s)",
+			Destination: &promptTimeoutArg,
+		},
+		cli.BoolFlag{
+			Name:        "mask",
+			Usage:       "Echo a * for each character of the passphrase typed at the terminal, instead of nothing",
+			Destination: &maskArg,
+		},
+		cli.StringFlag{
+			Name:        "passphrase-trim",
+			Usage:       "Normalize whitespace around the passphrase, whatever its source (except --keyfile): none, trailing-newline or all-surrounding",
+			Value:       "none",
+			Destination: &passphraseTrimArg,
+		},
+		cli.BoolFlag{
+			Name:        "agent",
+			Usage:       "Use the passphrase cached by the agent at $" + agent.SocketEnv + " (see the agent command) before prompting",
+			Destination: &agentArg,
+		},
+	}
+
+	app.Before = func(c *cli.Context) error {
+		var err error
+		trimPolicy, err = preader.ParseTrimPolicy(passphraseTrimArg)
+		return err
 	}
 
 	app.Commands = []cli.Command{
@@ -46,23 +194,124 @@ func main() {
 			Description: `Encrypts the contents of a file (the "input", specified with -i) and writes the encrypted output
    to another file (the "output", specified with -o).
 
-   If the output file does not exist, it will be created. If it does exist, it will be truncated and then written to.`,
+   If the output file does not exist, it will be created. If it does exist, it will be truncated and then written to.
+
+   With --stdout, the armored encrypted text is printed to stdout as a single line instead. Prompts go to stderr.
+
+   With --from-clipboard and --to-clipboard, the plain text is read from and the armored encrypted text is placed on
+   the system clipboard instead, without touching disk. Plain text read from the clipboard is cleared from it once
+   encrypted. On Linux and other Unix-like systems this requires wl-clipboard, xclip or xsel, and does not work
+   without a graphical session. Clipboard managers may retain a history of the plain text.`,
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:        "input, i",
 					Usage:       "Path to the file whose contents is to be encrypted",
-					Required:    true,
 					Destination: &inputArg,
 				},
 				cli.StringFlag{
 					Name:        "output, o",
-					Usage:       "Path to the file to write the encrypted text to",
-					Required:    true,
+					Usage:       "Path to the file to write the encrypted text to (required unless --stdout is given)",
 					Destination: &outputArg,
 				},
+				cli.StringSliceFlag{
+					Name:  "also-output",
+					Usage: "Also write the encrypted text to this path; may be repeated. No output is replaced unless all are written",
+					Value: &alsoOutputsArg,
+				},
+				cli.StringFlag{
+					Name:        "sign-key",
+					Usage:       "Also write a detached signature (<output>.sig) using the key in this file, for use with verify-sig",
+					Destination: &signKeyArg,
+				},
+				cli.BoolFlag{
+					Name:        "stdout",
+					Usage:       "Print the armored encrypted text to stdout instead of writing it to a file",
+					Destination: &stdoutArg,
+				},
+				cli.BoolFlag{
+					Name:        "estimate",
+					Usage:       "Print an estimate of the time key derivation will take before starting",
+					Destination: &estimateArg,
+				},
+				cli.BoolFlag{
+					Name:        "mkdir",
+					Usage:       "Create the output directory if it does not exist",
+					Destination: &mkdirArg,
+				},
+				cli.BoolFlag{
+					Name:        "verify-after-write",
+					Usage:       "Read back and decrypt the output after writing it, failing unless it matches the input",
+					Destination: &verifyAfterWriteArg,
+				},
+				cli.BoolFlag{
+					Name:        "only-if-changed",
+					Usage:       "Skip encryption if the input is unchanged since last encrypted, tracked in a <output>.meta sidecar file",
+					Destination: &onlyIfChangedArg,
+				},
+				cli.StringFlag{
+					Name:        "armor-encoding, armor-version",
+					Usage:       "Armor encoding of the output: " + strings.Join(varmor.Encodings(), ", ") + " (decrypt detects it automatically)",
+					Value:       "url",
+					Destination: &armorEncodingArg,
+				},
+				cli.BoolFlag{
+					Name:        "pem",
+					Usage:       "Write PEM-like output (line-wrapped between BEGIN and END lines); same as --armor-encoding pem",
+					Destination: &pemArg,
+				},
+				cli.StringFlag{
+					Name:        "keyfile",
+					Usage:       "Use the contents of this keyfile (see gen-keyfile) as the secret instead of a passphrase",
+					Destination: &secretKeyfileArg,
+				},
+				cli.BoolFlag{
+					Name:        "no-empty-passphrase",
+					Usage:       "Refuse to encrypt if the passphrase is empty",
+					Destination: &noEmptyPassphraseArg,
+				},
+				cli.BoolFlag{
+					Name:        "from-clipboard",
+					Usage:       "Read the plain text from the system clipboard instead of --input/-i, clearing it afterwards",
+					Destination: &fromClipboardArg,
+				},
+				cli.BoolFlag{
+					Name:        "to-clipboard",
+					Usage:       "Place the armored encrypted text on the system clipboard instead of writing it to --output/-o",
+					Destination: &toClipboardArg,
+				},
+				cli.BoolFlag{
+					Name:        "mmap",
+					Usage:       "Memory map the input instead of reading it, if possible, to reduce copying of large files",
+					Destination: &mmapArg,
+				},
 			},
 			Action: func(c *cli.Context) error {
-				return commands.Encrypt(inputArg, outputArg, getPassphraseReader())
+				if inputArg == "" && !fromClipboardArg {
+					return errors.New("either --input/-i or --from-clipboard is required")
+				}
+				if outputArg == "" && !stdoutArg && !toClipboardArg {
+					return errors.New("either --output/-o, --stdout or --to-clipboard is required")
+				}
+				if pemArg {
+					if c.IsSet("armor-encoding") && armorEncodingArg != "pem" {
+						return errors.New("--pem cannot be combined with a different --armor-encoding")
+					}
+					armorEncodingArg = "pem"
+				}
+				return commands.Encrypt(inputArg, outputArg, getPassphraseReader(), commands.EncryptOptions{
+					Estimate:          estimateArg,
+					Mkdir:             mkdirArg,
+					VerifyAfterWrite:  verifyAfterWriteArg,
+					OnlyIfChanged:     onlyIfChangedArg,
+					ArmorEncoding:     armorEncodingArg,
+					NoEmptyPassphrase: noEmptyPassphraseArg,
+					Stdout:            stdoutArg,
+					AlsoOutputs:       alsoOutputsArg,
+					SignKeyFile:       signKeyArg,
+					Mmap:              mmapArg,
+					FromClipboard:     fromClipboardArg,
+					ToClipboard:       toClipboardArg,
+				})
 			},
 		},
 		{
@@ -72,6 +321,8 @@ func main() {
 			Description: `Decrypts the contents of a file (the "input", specified with -i) and writes the plain text output
    to another file (the "output", specified with -o).
 
+   The input may also be an http:// or https:// URL, in which case it is fetched into memory before decrypting.
+
    If the output file does not exist, it will be created. If it does exist, it will be truncated and then written to.`,
 			Flags: []cli.Flag{
 				cli.StringFlag{
@@ -86,9 +337,75 @@ func main() {
 					Required:    true,
 					Destination: &outputArg,
 				},
+				cli.BoolFlag{
+					Name:        "estimate",
+					Usage:       "Print an estimate of the time key derivation will take before starting",
+					Destination: &estimateArg,
+				},
+				cli.BoolFlag{
+					Name:        "secure-tmp",
+					Usage:       "Write the output into a new private directory in a RAM-backed directory (using only the base name of -o; the path is printed), failing if none is available",
+					Destination: &secureTmpArg,
+				},
+				cli.BoolFlag{
+					Name:        "mkdir",
+					Usage:       "Create the output directory if it does not exist",
+					Destination: &mkdirArg,
+				},
+				cli.StringSliceFlag{
+					Name:  "header",
+					Usage: "Extra header (\"Name: value\") to send when the input is an HTTP(S) URL; may be repeated",
+					Value: &headersArg,
+				},
+				cli.StringFlag{
+					Name:        "ca",
+					Usage:       "Path to PEM encoded certificates to trust instead of the system roots when the input is an HTTPS URL",
+					Destination: &caArg,
+				},
+				cli.BoolFlag{
+					Name:        "strict",
+					Usage:       "Reject input that is not exactly in canonical armored form (including a trailing newline)",
+					Destination: &strictArg,
+				},
+				cli.BoolFlag{
+					Name:        "no-armor",
+					Usage:       "Treat the input as raw (unarmored) encrypted bytes, such as those produced by other implementations",
+					Destination: &noArmorArg,
+				},
+				cli.StringFlag{
+					Name:        "expect-format",
+					Usage:       "Fail without writing output unless the plain text parses as this format: json or yaml",
+					Destination: &expectFormatArg,
+				},
+				cli.BoolFlag{
+					Name:        "try-newline-variants",
+					Usage:       "If decryption fails, retry with a trailing newline added to or trailing whitespace removed from the passphrase",
+					Destination: &tryNewlineVariantsArg,
+				},
+				cli.StringFlag{
+					Name:        "keyfile",
+					Usage:       "Use the contents of this keyfile (see gen-keyfile) as the secret instead of a passphrase",
+					Destination: &secretKeyfileArg,
+				},
+				cli.StringFlag{
+					Name:        "max-age",
+					Usage:       "Refuse to decrypt if the input was last modified longer ago than this (e.g. 90d, 2w or 36h); based on the file modification time, which copying may reset",
+					Destination: &maxAgeArg,
+				},
 			},
 			Action: func(c *cli.Context) error {
-				return commands.Decrypt(inputArg, outputArg, getPassphraseReader())
+				return commands.Decrypt(inputArg, outputArg, getPassphraseReader(), commands.DecryptOptions{
+					Estimate:           estimateArg,
+					SecureTmp:          secureTmpArg,
+					Mkdir:              mkdirArg,
+					HTTPHeaders:        headersArg,
+					CAFile:             caArg,
+					Strict:             strictArg,
+					NoArmor:            noArmorArg,
+					ExpectFormat:       expectFormatArg,
+					TryNewlineVariants: tryNewlineVariantsArg,
+					MaxAge:             maxAgeArg,
+				})
 			},
 		},
 		{
@@ -100,7 +417,8 @@ func main() {
 
    If the output file does not already exist, or if it does not appear to be a valid saltybox file, the operation will fail.
 
-   If the passphrase provided by the user does unlock the existing file, the operation will fail. By using the update command,
+   If the passphrase provided by the user does not unlock the existing file, the operation will fail (after prompting again
+   up to --retries times, if the passphrase is read from the terminal). By using the update command,
    the user thereby avoids accidentally changing the passphrase as would be possible if using the encrypt command and separately
    replacing the target file.`,
 			Flags: []cli.Flag{
@@ -116,9 +434,812 @@ func main() {
 					Required:    true,
 					Destination: &outputArg,
 				},
+				cli.IntFlag{
+					Name:        "retries",
+					Usage:       "Number of times to prompt again if the passphrase does not unlock the existing file (terminal only)",
+					Value:       2,
+					Destination: &retriesArg,
+				},
+				cli.BoolFlag{
+					Name:        "dry-run",
+					Usage:       "Validate the passphrase and report whether the plain text would change, without modifying the output",
+					Destination: &dryRunArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if retriesArg < 0 {
+					return fmt.Errorf("--retries must not be negative, was %d", retriesArg)
+				}
+
+				opts := commands.UpdateOptions{DryRun: dryRunArg}
+				if promptsForPassphrase() {
+					opts.Retries = retriesArg
+				}
+
+				return commands.Update(inputArg, outputArg, getPassphraseReader(), opts)
+			},
+		},
+		{
+			Name:  "recover",
+			Usage: "Recover a forgotten passphrase from a list of candidates",
+			Description: `Tries each line of a wordlist (specified with --wordlist) as the passphrase of a saltybox file (the "input",
+   specified with -i), and reports the first candidate that successfully decrypts it.
+
+   This is a recovery tool meant for files you own but whose exact passphrase you no longer remember. Because key
+   derivation is deliberately expensive, candidates are tried concurrently (see --parallelism) and the search is
+   only practical for small lists of likely candidates.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "input, i",
+					Usage:       "Path to the saltybox file whose passphrase is to be recovered",
+					Required:    true,
+					Destination: &inputArg,
+				},
+				cli.StringFlag{
+					Name:        "wordlist",
+					Usage:       "Path to a file containing one candidate passphrase per line",
+					Required:    true,
+					Destination: &wordlistArg,
+				},
+				cli.IntFlag{
+					Name:        "parallelism",
+					Usage:       "Number of candidates to try concurrently",
+					Value:       runtime.NumCPU(),
+					Destination: &parallelismArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				passphrase, found, err := commands.Recover(inputArg, wordlistArg, parallelismArg, os.Stderr)
+				if err != nil {
+					return err
+				}
+				if !found {
+					return errors.New("no candidate passphrase decrypted the file")
+				}
+
+				_, err = fmt.Printf("Passphrase found: %s\n", passphrase)
+				return err
+			},
+		},
+		{
+			Name:  "verify-dir",
+			Usage: "Verify that all saltybox files in a directory decrypt with a passphrase",
+			Description: `Walks a directory (specified with --dir) and attempts to decrypt every saltybox file in it, and in its
+   subdirectories, with a single passphrase. Other files are skipped. Prints the result for each file followed by a
+   summary, and fails if any file did not decrypt. No plain text is written.
+
+   Because key derivation is deliberately expensive, files are checked concurrently (see --parallelism).`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "dir",
+					Usage:       "Path to the directory to verify",
+					Required:    true,
+					Destination: &dirArg,
+				},
+				cli.IntFlag{
+					Name:        "parallelism",
+					Usage:       "Number of files to check concurrently",
+					Value:       runtime.NumCPU(),
+					Destination: &parallelismArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return commands.VerifyDir(dirArg, getPassphraseReader(), parallelismArg, os.Stdout)
+			},
+		},
+		{
+			Name:  "audit-perms",
+			Usage: "Report saltybox files in a directory which are accessible by group or others",
+			Description: `Walks a directory (specified with --dir) and reports every saltybox file in it, and in its subdirectories,
+   which is readable or writable by group or others. Fails if any are found, unless --fix is given, in which case
+   they are changed to mode 0600. Other files are not checked. No passphrase is required.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "dir",
+					Usage:       "Path to the directory to audit",
+					Required:    true,
+					Destination: &dirArg,
+				},
+				cli.BoolFlag{
+					Name:        "fix",
+					Usage:       "Change the mode of offending files to 0600",
+					Destination: &fixArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return commands.AuditPerms(dirArg, fixArg, os.Stdout)
+			},
+		},
+		{
+			Name:  "stego-embed",
+			Usage: "Encrypt a file and hide it in a PNG image",
+			Description: `Encrypts the contents of a file (the "input", specified with -i) and embeds the encrypted output in the
+   least significant bits of a PNG image (the "cover", specified with --cover), writing the resulting image to
+   another file (the "output", specified with -o).
+
+   The operation fails if the cover image is too small to hold the encrypted data.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "input, i",
+					Usage:       "Path to the file whose contents is to be encrypted",
+					Required:    true,
+					Destination: &inputArg,
+				},
+				cli.StringFlag{
+					Name:        "cover",
+					Usage:       "Path to the PNG image to hide the encrypted data in",
+					Required:    true,
+					Destination: &coverArg,
+				},
+				cli.StringFlag{
+					Name:        "out, o",
+					Usage:       "Path to the file to write the resulting PNG image to",
+					Required:    true,
+					Destination: &outputArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return commands.StegoEmbed(inputArg, coverArg, outputArg, getPassphraseReader())
+			},
+		},
+		{
+			Name:  "stego-extract",
+			Usage: "Extract and decrypt a file hidden in a PNG image",
+			Description: `Extracts encrypted data previously hidden with stego-embed from a PNG image (the "input", specified with -i),
+   decrypts it and writes the plain text output to another file (the "output", specified with -o).`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "input, i",
+					Usage:       "Path to the PNG image containing hidden encrypted data",
+					Required:    true,
+					Destination: &inputArg,
+				},
+				cli.StringFlag{
+					Name:        "output, o",
+					Usage:       "Path to the file to write the unencrypted text to",
+					Required:    true,
+					Destination: &outputArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return commands.StegoExtract(inputArg, outputArg, getPassphraseReader())
+			},
+		},
+		{
+			Name:  "gen-keyfile",
+			Usage: "Generate a random keyfile",
+			Description: `Writes a new keyfile (the "output", specified with -o) consisting of random bytes, readable only by
+   the owner. The keyfile can be used with --keyfile when encrypting and decrypting.
+
+   An existing output file is never overwritten unless --force is given, since that may destroy the only copy of a key.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "output, o",
+					Usage:       "Path to the keyfile to create",
+					Required:    true,
+					Destination: &outputArg,
+				},
+				cli.IntFlag{
+					Name:        "bytes",
+					Usage:       "Number of random bytes in the keyfile",
+					Value:       32,
+					Destination: &bytesArg,
+				},
+				cli.BoolFlag{
+					Name:        "force",
+					Usage:       "Overwrite the output file if it already exists",
+					Destination: &forceArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return commands.GenKeyfile(outputArg, bytesArg, forceArg)
+			},
+		},
+		{
+			Name:  "to-keyfile",
+			Usage: "Re-encrypt a passphrase protected file using a keyfile",
+			Description: `Decrypts an existing saltybox file (the "input", specified with -i) using a passphrase and re-encrypts it
+   using the contents of a keyfile (specified with --keyfile) as the secret. The file is replaced atomically.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "input, i",
+					Usage:       "Path to the saltybox file to re-encrypt",
+					Required:    true,
+					Destination: &inputArg,
+				},
+				cli.StringFlag{
+					Name:        "keyfile",
+					Usage:       "Path to the keyfile to use as the new secret",
+					Required:    true,
+					Destination: &keyfileArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return commands.Rekey(inputArg, getPassphraseReader(), preader.NewFile(keyfileArg))
+			},
+		},
+		{
+			Name:  "from-keyfile",
+			Usage: "Re-encrypt a keyfile protected file using a passphrase",
+			Description: `Decrypts an existing saltybox file (the "input", specified with -i) using the contents of a keyfile
+   (specified with --keyfile) as the secret and re-encrypts it using a passphrase. The file is replaced atomically.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "input, i",
+					Usage:       "Path to the saltybox file to re-encrypt",
+					Required:    true,
+					Destination: &inputArg,
+				},
+				cli.StringFlag{
+					Name:        "keyfile",
+					Usage:       "Path to the keyfile currently protecting the file",
+					Required:    true,
+					Destination: &keyfileArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return commands.Rekey(inputArg, preader.NewFile(keyfileArg), getPassphraseReader())
+			},
+		},
+		{
+			Name:  "encrypt-dual",
+			Usage: "Encrypt a file such that two passphrases are required to decrypt it",
+			Description: `Encrypts the contents of a file (the "input", specified with -i) with a first passphrase, encrypts the
+   result again with a second passphrase, and writes it to another file (the "output", specified with -o).
+
+   Both passphrases, in the same order, are required to decrypt the output with decrypt-dual. Both are prompted for
+   at the terminal, the first and then the second; other passphrase sources are rejected. The two passphrases must
+   differ.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "input, i",
+					Usage:       "Path to the file whose contents is to be encrypted",
+					Required:    true,
+					Destination: &inputArg,
+				},
+				cli.StringFlag{
+					Name:        "output, o",
+					Usage:       "Path to the file to write the encrypted text to",
+					Required:    true,
+					Destination: &outputArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if err := checkDualPassphraseSource(); err != nil {
+					return err
+				}
+				return commands.EncryptDualFile(inputArg, outputArg, getPassphraseReader(), getPassphraseReader())
+			},
+		},
+		{
+			Name:  "decrypt-dual",
+			Usage: "Decrypt a file encrypted with encrypt-dual",
+			Description: `Decrypts the contents of a file (the "input", specified with -i) produced by encrypt-dual and writes the
+   plain text to another file (the "output", specified with -o).
+
+   Both passphrases are prompted for at the terminal, the first and then the second, in the same order as when
+   encrypting. Other passphrase sources are rejected.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "input, i",
+					Usage:       "Path to the file whose contents is to be decrypted",
+					Required:    true,
+					Destination: &inputArg,
+				},
+				cli.StringFlag{
+					Name:        "output, o",
+					Usage:       "Path to the file to write the unencrypted text to",
+					Required:    true,
+					Destination: &outputArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if err := checkDualPassphraseSource(); err != nil {
+					return err
+				}
+				return commands.DecryptDualFile(inputArg, outputArg, getPassphraseReader(), getPassphraseReader())
+			},
+		},
+		{
+			Name:  "passphrase-entropy",
+			Usage: "Estimate the entropy of a candidate passphrase",
+			Description: `Reads a candidate passphrase (from the terminal without echoing it, unless another passphrase source
+   is given) and prints an estimate of its entropy in bits, based on its length and the classes of characters
+   used. The passphrase is not printed, stored or transmitted.
+
+   The estimate is an upper bound. A passphrase made of words or patterns has far less entropy than its length
+   suggests.`,
+			Action: func(c *cli.Context) error {
+				return commands.PassphraseEntropy(getPassphraseReader(), os.Stdout)
+			},
+		},
+		{
+			Name:  "agent",
+			Usage: "Run a passphrase agent",
+			Description: `Runs an agent which caches a passphrase in memory, so that it need only be entered once when running
+   several commands in a row. The agent listens on a new unix socket (specified with --socket) accessible only by the
+   owner, and never over the network. Connections from other users are rejected by checking peer credentials, which
+   is only supported on Linux and macOS. It runs until interrupted.
+
+   Other commands use the agent when given the global --agent flag and the socket path in $` + agent.SocketEnv + `.
+   The passphrase entered at the first prompt is cached, and expires (and is wiped from memory) after --ttl. Use agent-clear to forget a
+   mistyped passphrase.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "socket",
+					Usage:       "Path of the unix socket to create",
+					Required:    true,
+					Destination: &socketArg,
+				},
+				cli.DurationFlag{
+					Name:        "ttl",
+					Usage:       "How long a passphrase is cached after being entered",
+					Value:       15 * time.Minute,
+					Destination: &ttlArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return commands.RunAgent(socketArg, ttlArg)
+			},
+		},
+		{
+			Name:  "agent-clear",
+			Usage: "Forget the passphrase cached by the agent",
+			Description: `Removes any passphrase cached by the agent whose socket is at $` + agent.SocketEnv + `, such as one that
+   was mistyped.`,
+			Action: func(c *cli.Context) error {
+				return commands.ClearAgent(os.Getenv(agent.SocketEnv))
+			},
+		},
+		{
+			Name:  "split-passphrase",
+			Usage: "Split a passphrase into Shamir shares",
+			Description: `Reads a passphrase and splits it into a number of shares (specified with --shares), any number of which
+   (specified with --threshold) are sufficient to reconstruct it. The shares are written to stdout, one per line.
+
+   Use combine-passphrase to decrypt a file using the shares.`,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:        "shares",
+					Usage:       "Number of shares to produce",
+					Required:    true,
+					Destination: &sharesArg,
+				},
+				cli.IntFlag{
+					Name:        "threshold",
+					Usage:       "Number of shares required to reconstruct the passphrase",
+					Required:    true,
+					Destination: &thresholdArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return commands.SplitPassphrase(getPassphraseReader(), sharesArg, thresholdArg, os.Stdout)
+			},
+		},
+		{
+			Name:  "combine-passphrase",
+			Usage: "Decrypt a file using a passphrase reconstructed from Shamir shares",
+			Description: `Reconstructs a passphrase from shares produced by split-passphrase (read from a file specified with
+   --shares-file, one share per line) and uses it to decrypt the contents of a file (the "input", specified with -i),
+   writing the plain text output to another file (the "output", specified with -o).
+
+   Supplying fewer shares than the threshold, or shares from different splits, fails before decryption is attempted.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "input, i",
+					Usage:       "Path to the file whose contents is to be decrypted",
+					Required:    true,
+					Destination: &inputArg,
+				},
+				cli.StringFlag{
+					Name:        "output, o",
+					Usage:       "Path to the file to write the unencrypted text to",
+					Required:    true,
+					Destination: &outputArg,
+				},
+				cli.StringFlag{
+					Name:        "shares-file",
+					Usage:       "Path to a file containing shares, one per line",
+					Required:    true,
+					Destination: &sharesFileArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return commands.Decrypt(inputArg, outputArg, preader.NewShares(sharesFileArg), commands.DecryptOptions{})
+			},
+		},
+		{
+			Name:  "wrap",
+			Usage: "Armor stdin to stdout without encrypting",
+			Description: `Reads arbitrary bytes from stdin and writes them to stdout in saltybox's armored form, which is safe to
+   embed in URLs and to pass unescaped in a POSIX shell.
+
+   This does NOT encrypt anything. Use encrypt for that.`,
+			Action: func(c *cli.Context) error {
+				return commands.Wrap(os.Stdin, os.Stdout)
+			},
+		},
+		{
+			Name:  "unwrap",
+			Usage: "Unarmor stdin to stdout without decrypting",
+			Description: `Reads armored data (as produced by wrap) from stdin and writes the original bytes to stdout.
+
+   This does NOT decrypt anything. Use decrypt for that.`,
+			Action: func(c *cli.Context) error {
+				return commands.Unwrap(os.Stdin, os.Stdout)
+			},
+		},
+		{
+			Name:  "reencode",
+			Usage: "Change the armor encoding of blobs read from stdin, without decrypting",
+			Description: `Reads armored blobs from stdin, one per line, and writes each to stdout armored using the encoding given
+   by --to (one of ` + strings.Join(varmor.Encodings(), ", ") + `). Empty lines are passed through.
+
+   Only the armor changes; nothing is decrypted and no passphrase is needed. If --from is given, every blob
+   must be in that encoding.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "from",
+					Usage:       "Require all input blobs to be in this encoding",
+					Destination: &fromEncodingArg,
+				},
+				cli.StringFlag{
+					Name:        "to",
+					Usage:       "Encoding to re-armor blobs with",
+					Required:    true,
+					Destination: &toEncodingArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return commands.Reencode(os.Stdin, os.Stdout, fromEncodingArg, toEncodingArg)
+			},
+		},
+		{
+			Name:  "bench-armor",
+			Usage: "Measure armoring throughput",
+			Description: `Times armoring and unarmoring (as done by wrap and unwrap) of random data and reports throughput and
+   memory allocations. This is purely diagnostic and does not encrypt anything.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "size",
+					Usage:       "Amount of random data to use, such as 100MB (suffixes KB, MB and GB are powers of 1024)",
+					Value:       "100MB",
+					Destination: &sizeArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return commands.BenchArmor(sizeArg, os.Stdout)
+			},
+		},
+		{
+			Name:  "repair",
+			Usage: "Remove trailing junk appended to a saltybox file in transfer",
+			Description: `Removes trailing junk, such as a newline or NUL bytes appended by some transfer tools, from a saltybox
+   file (the "input", specified with -i), which is rewritten in place. The repaired file must decrypt with the
+   passphrase before it is written, and repair is refused if there is more junk than transfer artifacts would
+   explain, since that indicates real corruption.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "input, i",
+					Usage:       "Path to the saltybox file to repair",
+					Required:    true,
+					Destination: &inputArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return commands.Repair(inputArg, getPassphraseReader(), os.Stderr)
+			},
+		},
+		{
+			Name:  "info",
+			Usage: "Describe a saltybox file without decrypting it",
+			Description: `Describes the unencrypted framing of a saltybox file (the "input", specified with -i) without decrypting
+   it. No passphrase is required.
+
+   By default only lengths are printed. Use --fields to also print the salt and nounce, which are not secret, in
+   the given encoding (hex or base64).`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "input, i",
+					Usage:       "Path to the saltybox file to describe",
+					Required:    true,
+					Destination: &inputArg,
+				},
+				cli.StringFlag{
+					Name:        "fields",
+					Usage:       "Also print the salt and nounce in the given encoding (hex or base64)",
+					Destination: &fieldsArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return commands.Info(inputArg, fieldsArg, os.Stdout)
+			},
+		},
+		{
+			Name:  "explain",
+			Usage: "Show how large a file would be once encrypted, and why",
+			Description: `Prints a breakdown of the size of the saltybox file that encrypting a file (the "input", specified with -i)
+   would produce: the plain text, the secretbox authentication tag, the salt, the nounce, the length field and
+   finally the expansion due to armor. Nothing is encrypted, and no passphrase is required.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "input, i",
+					Usage:       "Path to the plain text file",
+					Required:    true,
+					Destination: &inputArg,
+				},
+				cli.StringFlag{
+					Name:        "armor-encoding",
+					Usage:       "Armor encoding to calculate for: " + strings.Join(varmor.Encodings(), ", "),
+					Value:       "url",
+					Destination: &armorEncodingArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return commands.Explain(inputArg, armorEncodingArg, os.Stdout)
+			},
+		},
+		{
+			Name:  "raw-box",
+			Usage: "Print the still-encrypted sealed box of a saltybox file",
+			Description: `Strips the armor and the salt, nounce and length framing from a saltybox file (the "input", specified
+   with -i) and prints just the NaCl secretbox sealed box, preceded by a comment line. No passphrase is required.
+
+   The output is STILL ENCRYPTED. This is a diagnostic aid for inspecting the format and for use with other NaCl
+   tooling; use decrypt to obtain the plain text.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "input, i",
+					Usage:       "Path to the saltybox file",
+					Required:    true,
+					Destination: &inputArg,
+				},
+				cli.StringFlag{
+					Name:        "encoding",
+					Usage:       "Encoding of the sealed box (hex or base64)",
+					Value:       "base64",
+					Destination: &rawBoxEncodingArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return commands.RawBox(inputArg, rawBoxEncodingArg, os.Stdout)
+			},
+		},
+		{
+			Name:  "kdf-profile",
+			Usage: "Measure key derivation time and memory for various scrypt parameters",
+			Description: `Performs a single key derivation for each given value of the scrypt N parameter (the other parameters
+   being the defaults) and prints the time taken and memory allocated, as well as the expected memory requirement.
+   Useful for deciding how many decryptions a machine can perform concurrently.
+
+   Files are always encrypted using the default parameters (N=32768); this does not change them.`,
+			Flags: []cli.Flag{
+				cli.IntSliceFlag{
+					Name:  "n",
+					Usage: "Value of N to profile; may be repeated (default: 16384, 32768, 65536, 131072, 262144)",
+					Value: &kdfNsArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				ns := []int(kdfNsArg)
+				if len(ns) == 0 {
+					ns = []int{16384, 32768, 65536, 131072, 262144}
+				}
+				return commands.KDFProfile(ns, os.Stdout)
+			},
+		},
+		{
+			Name:  "cost-estimate",
+			Usage: "Estimate the cost of brute-forcing a file's passphrase",
+			Description: `Prints a rough estimate of the expected time needed to brute-force the passphrase of a saltybox file (the
+   "input", specified with -i), assuming a passphrase with the given entropy (see passphrase-entropy). The estimate
+   is extrapolated from the time taken by one real key derivation on this machine. No passphrase is required.
+
+   Files do not record their key derivation parameters. All files use the same fixed parameters, so the estimate does
+   not depend on the input, which is only validated.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "input, i",
+					Usage:       "Path to the saltybox file",
+					Required:    true,
+					Destination: &inputArg,
+				},
+				cli.Float64Flag{
+					Name:        "entropy-bits",
+					Usage:       "Assumed entropy of the passphrase in bits",
+					Required:    true,
+					Destination: &entropyBitsArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return commands.CostEstimate(inputArg, entropyBitsArg, os.Stdout)
+			},
+		},
+		{
+			Name:  "to-detached",
+			Usage: "Split a saltybox file into a separate header and body",
+			Description: `Splits a saltybox file (the "input", specified with -i) into its unencrypted header (salt, nounce and
+   length, written to --header-out) and its still encrypted body (the sealed box, written to --body-out). Both are
+   written as raw bytes.
+
+   No passphrase is required since nothing is decrypted. Use to-combined to reverse the operation.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "input, i",
+					Usage:       "Path to the saltybox file to split",
+					Required:    true,
+					Destination: &inputArg,
+				},
+				cli.StringFlag{
+					Name:        "header-out",
+					Usage:       "Path to the file to write the header to",
+					Required:    true,
+					Destination: &headerArg,
+				},
+				cli.StringFlag{
+					Name:        "body-out",
+					Usage:       "Path to the file to write the body to",
+					Required:    true,
+					Destination: &bodyArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return commands.ToDetached(inputArg, headerArg, bodyArg)
+			},
+		},
+		{
+			Name:  "to-combined",
+			Usage: "Join a separate header and body into a saltybox file",
+			Description: `Joins a header (specified with --header) and body (specified with --body), as produced by to-detached,
+   into a regular saltybox file (the "output", specified with -o).
+
+   The detached form does not record the armor encoding of the original file; pass --armor-encoding to reproduce
+   an encoding other than the default.
+
+   No passphrase is required since nothing is decrypted.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "header",
+					Usage:       "Path to the header file",
+					Required:    true,
+					Destination: &headerArg,
+				},
+				cli.StringFlag{
+					Name:        "body",
+					Usage:       "Path to the body file",
+					Required:    true,
+					Destination: &bodyArg,
+				},
+				cli.StringFlag{
+					Name:        "output, o",
+					Usage:       "Path to the file to write the saltybox file to",
+					Required:    true,
+					Destination: &outputArg,
+				},
+				cli.StringFlag{
+					Name:        "armor-encoding",
+					Usage:       "Armor encoding of the output: " + strings.Join(varmor.Encodings(), ", "),
+					Value:       "url",
+					Destination: &armorEncodingArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return commands.ToCombined(headerArg, bodyArg, outputArg, armorEncodingArg)
+			},
+		},
+		{
+			Name:  "verify-sig",
+			Usage: "Verify the detached signature of an encrypted file",
+			Description: `Verifies the detached signature written by encrypt --sign-key for a saltybox file (the "input", specified
+   with -i), using the same signing key. No passphrase is required since nothing is decrypted.
+
+   This checks that the file was not modified in transit. It says nothing about who can decrypt it.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "input, i",
+					Usage:       "Path to the saltybox file to verify",
+					Required:    true,
+					Destination: &inputArg,
+				},
+				cli.StringFlag{
+					Name:        "sign-key",
+					Usage:       "Path to the signing key",
+					Required:    true,
+					Destination: &signKeyArg,
+				},
+				cli.StringFlag{
+					Name:        "sig",
+					Usage:       "Path to the signature (default: <input>.sig)",
+					Destination: &sigArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return commands.VerifySignature(inputArg, sigArg, signKeyArg)
+			},
+		},
+		{
+			Name:  "to-age",
+			Usage: "Convert a saltybox file into an age file",
+			Description: `Decrypts a saltybox file (the "input", specified with -i) using a passphrase and encrypts the plain text
+   to one or more age recipients (specified with --recipient), writing the age file to the "output" (specified
+   with -o). The plain text is never written to disk.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "input, i",
+					Usage:       "Path to the saltybox file to convert",
+					Required:    true,
+					Destination: &inputArg,
+				},
+				cli.StringFlag{
+					Name:        "output, o",
+					Usage:       "Path to the age file to write",
+					Required:    true,
+					Destination: &outputArg,
+				},
+				cli.StringSliceFlag{
+					Name:  "recipient, r",
+					Usage: "age recipient (age1...) to encrypt to; may be repeated",
+					Value: &recipientsArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return commands.ToAge(inputArg, outputArg, recipientsArg, getPassphraseReader())
+			},
+		},
+		{
+			Name:  "from-age",
+			Usage: "Convert an age file into a saltybox file",
+			Description: `Decrypts an age file (the "input", specified with -i, binary or armored) using the identities in an
+   age identity file (specified with --identity) and encrypts the plain text using a passphrase, writing the
+   saltybox file to the "output" (specified with -o). The plain text is never written to disk.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "input, i",
+					Usage:       "Path to the age file to convert",
+					Required:    true,
+					Destination: &inputArg,
+				},
+				cli.StringFlag{
+					Name:        "output, o",
+					Usage:       "Path to the saltybox file to write",
+					Required:    true,
+					Destination: &outputArg,
+				},
+				cli.StringFlag{
+					Name:        "identity",
+					Usage:       "Path to the age identity file (as produced by age-keygen)",
+					Required:    true,
+					Destination: &identityArg,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return commands.FromAge(inputArg, outputArg, identityArg, getPassphraseReader())
+			},
+		},
+		{
+			Name:  "import-raw",
+			Usage: "Armor raw encrypted bytes produced by another implementation",
+			Description: `Reads raw (unarmored) encrypted bytes in saltybox's format (the "input", specified with -i), such as those
+   produced by another implementation, and writes them as a regular saltybox file (the "output", specified with -o).
+
+   No passphrase is required since nothing is decrypted. Such raw input can also be decrypted directly using
+   decrypt --no-armor.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "input, i",
+					Usage:       "Path to the file containing raw encrypted bytes",
+					Required:    true,
+					Destination: &inputArg,
+				},
+				cli.StringFlag{
+					Name:        "output, o",
+					Usage:       "Path to the saltybox file to write",
+					Required:    true,
+					Destination: &outputArg,
+				},
 			},
 			Action: func(c *cli.Context) error {
-				return commands.Update(inputArg, outputArg, getPassphraseReader())
+				return commands.ImportRaw(inputArg, outputArg)
 			},
 		},
 	}
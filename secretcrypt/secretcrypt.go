@@ -11,6 +11,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"runtime"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/nacl/secretbox"
 	"golang.org/x/crypto/scrypt"
@@ -30,13 +33,117 @@ const (
 
 	keyLen             = 32
 	secretboxNounceLen = 24
+	sealedBoxLenLen    = 8 // Length of the sealed box length field in number of bytes.
+
+	// Value of N used when calibrating for the purpose of estimating key derivation time. scrypt's cost is
+	// linear in N, so the real cost can be extrapolated from a cheap run.
+	calibrationScryptN = 1024
+)
+
+// Params are the scrypt parameters used for key derivation.
+type Params struct {
+	N int
+	R int
+	P int
+}
+
+// DefaultParams returns the scrypt parameters used for key derivation. All data produced by Encrypt uses these
+// parameters.
+func DefaultParams() Params {
+	return Params{N: scryptN, R: scryptR, P: scryptP}
+}
+
+// KDF derives keys from passphrases.
+type KDF interface {
+	// Derive derives a key of keyLen bytes from passphrase and salt.
+	Derive(passphrase string, salt []byte, keyLen int) ([]byte, error)
+}
+
+// ScryptKDF is a KDF which uses scrypt with the given parameters.
+type ScryptKDF struct {
+	Params Params
+}
+
+func (k ScryptKDF) Derive(passphrase string, salt []byte, keyLen int) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, k.Params.N, k.Params.R, k.Params.P, keyLen)
+}
+
+// DefaultKDF returns the KDF used by Encrypt and Decrypt: scrypt with DefaultParams. Since the format does not
+// identify the KDF, this can never change. Other KDFs can be used with EncryptWithKDF and DecryptWithKDF.
+func DefaultKDF() KDF {
+	return ScryptKDF{Params: DefaultParams()}
+}
+
+// ScryptMemory returns the approximate number of bytes of memory required for a key derivation with the given
+// parameters.
+func ScryptMemory(params Params) int64 {
+	return 128 * int64(params.N) * int64(params.R)
+}
+
+// HeaderLen is the length in bytes of the unencrypted header (salt, nounce and sealed box length) which precedes
+// the sealed box in data produced by Encrypt. Anything shorter cannot possibly be valid.
+const HeaderLen = saltLen + secretboxNounceLen + sealedBoxLenLen
+
+// Header describes the unencrypted framing of data produced by Encrypt. None of it is secret.
+type Header struct {
+	Salt         [saltLen]byte
+	Nounce       [secretboxNounceLen]byte
+	SealedBoxLen int64
+}
+
+// ErrTruncated is returned by Decrypt when the input is too short to possibly be valid, which is almost
+// always the result of an incomplete transfer or copy.
+var ErrTruncated = errors.New("input appears truncated (shorter than the smallest possible valid input); re-download or restore from backup")
+
+// ErrAuthentication is returned by Decrypt when the sealed box fails to authenticate. A wrong passphrase is
+// indistinguishable from corrupt or tampered-with input.
+var ErrAuthentication = errors.New("corrupt input, tampered-with data, or bad passphrase")
+
+// Limiter controls access to key derivation, which is deliberately expensive in both CPU and memory. Server
+// side users can install one (see SetLimiter) to, for example, bound the number of concurrent derivations with
+// a semaphore or rate limit them with a token bucket.
+type Limiter interface {
+	// Acquire is called before each key derivation. If it returns an error, the derivation is not performed
+	// and the error is returned to the caller of Encrypt/Decrypt.
+	Acquire() error
+
+	// Release is called after each key derivation for which Acquire succeeded.
+	Release()
+}
+
+var (
+	limiterMu sync.RWMutex
+	limiter   Limiter
 )
 
-func genKey(passphrase string, salt []byte) (*[keyLen]byte, error) {
-	secretKey, err := scrypt.Key([]byte(passphrase), salt[:], scryptN, scryptR, scryptP, keyLen)
+// SetLimiter installs a Limiter to be used around all subsequent key derivations. Passing nil removes any
+// installed Limiter, which is the default.
+func SetLimiter(l Limiter) {
+	limiterMu.Lock()
+	defer limiterMu.Unlock()
+
+	limiter = l
+}
+
+func genKey(kdf KDF, passphrase string, salt []byte) (*[keyLen]byte, error) {
+	limiterMu.RLock()
+	l := limiter
+	limiterMu.RUnlock()
+
+	if l != nil {
+		if err := l.Acquire(); err != nil {
+			return nil, fmt.Errorf("key derivation not permitted by limiter: %v", err)
+		}
+		defer l.Release()
+	}
+
+	secretKey, err := kdf.Derive(passphrase, salt, keyLen)
 	if err != nil {
 		return nil, err
 	}
+	if len(secretKey) != keyLen {
+		return nil, fmt.Errorf("KDF returned a key of %d bytes, but %d were requested", len(secretKey), keyLen)
+	}
 
 	// Copy merely to obtain a value of type [keyLen]byte for the caller's convenience (due to
 	// secretbox's API).
@@ -46,10 +153,53 @@ func genKey(passphrase string, salt []byte) (*[keyLen]byte, error) {
 	return &secretKeyCopy, nil
 }
 
+// EstimateKeyDerivation estimates the time a single key derivation (as performed by Encrypt and Decrypt)
+// will take on this machine.
+//
+// The estimate is obtained by timing a much cheaper derivation and extrapolating. It is purely informational
+// and has no effect on actual key derivation.
+func EstimateKeyDerivation() (time.Duration, error) {
+	var salt [saltLen]byte
+
+	start := time.Now()
+	_, err := ScryptKDF{Params: Params{N: calibrationScryptN, R: scryptR, P: scryptP}}.Derive("calibration", salt[:], keyLen)
+	if err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(start)
+
+	return elapsed * (scryptN / calibrationScryptN), nil
+}
+
+// MeasureKeyDerivation performs a single key derivation with the given parameters and returns how long it took.
+// It is intended for profiling alternative parameters; no data produced by Encrypt uses anything but
+// DefaultParams.
+func MeasureKeyDerivation(params Params) (time.Duration, error) {
+	var salt [saltLen]byte
+
+	start := time.Now()
+	_, err := ScryptKDF{Params: params}.Derive("calibration", salt[:], keyLen)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Since(start), nil
+}
+
 // Encrypt encrypts bytes using a passphrase.
 //
 // Returns encrypted bytes and an error, if any.
 func Encrypt(passphrase string, plaintext []byte) ([]byte, error) {
+	return EncryptWithKDF(DefaultKDF(), passphrase, plaintext)
+}
+
+// EncryptWithKDF is like Encrypt, except that the key is derived from the passphrase using kdf rather than
+// DefaultKDF. This is intended for experimenting with other KDFs.
+//
+// The output is in the same format, which does not record the KDF used: it can only be decrypted by
+// DecryptWithKDF with the same KDF, and not by Decrypt (or saltybox) unless kdf derives the same keys as
+// DefaultKDF.
+func EncryptWithKDF(kdf KDF, passphrase string, plaintext []byte) ([]byte, error) {
 	var salt [saltLen]byte
 	n, err := rand.Read(salt[:])
 	if err != nil {
@@ -59,11 +209,6 @@ func Encrypt(passphrase string, plaintext []byte) ([]byte, error) {
 		return nil, fmt.Errorf("rand.Read() should always return the requested length, but did not: %v", n)
 	}
 
-	secretKey, err := genKey(passphrase, salt[:])
-	if err != nil {
-		return nil, err
-	}
-
 	var nounce [secretboxNounceLen]byte
 	n, err = rand.Read(nounce[:])
 	if err != nil {
@@ -73,79 +218,158 @@ func Encrypt(passphrase string, plaintext []byte) ([]byte, error) {
 		return nil, fmt.Errorf("rand.Read() should always return the requested length, but did not: %v", n)
 	}
 
+	return encryptWithSaltAndNounce(kdf, passphrase, plaintext, &salt, &nounce)
+}
+
+// EncryptDeterministicBytes is like Encrypt, except that the salt and nounce are provided by the caller rather
+// than randomly generated. The output is therefore fully determined by the input.
+//
+// This exists for generating reproducible test data only. Never use it to encrypt real data; reusing a nounce
+// with the same key breaks the confidentiality of everything encrypted with it.
+//
+// An error is returned unless salt is exactly 8 bytes and nounce exactly 24 bytes long.
+func EncryptDeterministicBytes(passphrase string, plaintext []byte, salt []byte, nounce []byte) ([]byte, error) {
+	if len(salt) != saltLen {
+		return nil, fmt.Errorf("salt must be %d bytes, was %d", saltLen, len(salt))
+	}
+	if len(nounce) != secretboxNounceLen {
+		return nil, fmt.Errorf("nounce must be %d bytes, was %d", secretboxNounceLen, len(nounce))
+	}
+
+	var saltArray [saltLen]byte
+	copy(saltArray[:], salt)
+	var nounceArray [secretboxNounceLen]byte
+	copy(nounceArray[:], nounce)
+
+	return encryptWithSaltAndNounce(DefaultKDF(), passphrase, plaintext, &saltArray, &nounceArray)
+}
+
+func encryptWithSaltAndNounce(kdf KDF, passphrase string, plaintext []byte, salt *[saltLen]byte, nounce *[secretboxNounceLen]byte) ([]byte, error) {
+	secretKey, err := genKey(kdf, passphrase, salt[:])
+	if err != nil {
+		return nil, err
+	}
+
 	sealedBox := secretbox.Seal(
 		nil,
 		plaintext,
-		&nounce,
+		nounce,
 		secretKey,
 	)
 
-	var buf bytes.Buffer
-	if _, err = buf.Write(salt[:]); err != nil {
-		return nil, fmt.Errorf("infallible Write() failed: %v", err)
-	}
-	if _, err = buf.Write(nounce[:]); err != nil {
-		return nil, fmt.Errorf("infallible Write() failed: %v", err)
-	}
-	if err = binary.Write(&buf, binary.BigEndian, int64(len(sealedBox))); err != nil {
-		return nil, fmt.Errorf("infallible Write() failed: %v", err)
-	}
-	if _, err = buf.Write(sealedBox); err != nil {
-		return nil, fmt.Errorf("infallible Write() failed: %v", err)
-	}
+	return Assemble(*salt, *nounce, sealedBox), nil
+}
 
-	return buf.Bytes(), nil
+// CiphertextLen returns the length of the data Encrypt produces for a plain text of plaintextLen bytes: the header
+// plus the sealed box, which is secretbox.Overhead bytes longer than the plain text.
+func CiphertextLen(plaintextLen int64) int64 {
+	return HeaderLen + secretbox.Overhead + plaintextLen
 }
 
-// Decrypt decrypts a sequence of bytes previously created with Encrypt.
+// Assemble produces data in the format produced by Encrypt from its pre-computed components: the salt used for key
+// derivation, the nounce, and the sealed box produced by secretbox.Seal using the derived key.
 //
-// Errors conditions include (but may not be limited to):
+// This allows code which performs key derivation and sealing itself to produce data which Decrypt (given the
+// right passphrase) can decrypt, provided the key was derived from the passphrase and salt using scrypt with
+// DefaultParams and a 32 byte key length. See also Disassemble.
+func Assemble(salt [saltLen]byte, nounce [secretboxNounceLen]byte, sealedBox []byte) []byte {
+	crypttext := make([]byte, 0, HeaderLen+len(sealedBox))
+	crypttext = append(crypttext, salt[:]...)
+	crypttext = append(crypttext, nounce[:]...)
+
+	var sealedBoxLen [sealedBoxLenLen]byte
+	binary.BigEndian.PutUint64(sealedBoxLen[:], uint64(len(sealedBox)))
+	crypttext = append(crypttext, sealedBoxLen[:]...)
+
+	return append(crypttext, sealedBox...)
+}
+
+// Disassemble is the inverse of Assemble; it splits data produced by Encrypt into its salt, nounce and sealed box
+// without decrypting anything. The returned sealed box refers to the same underlying memory as crypttext.
 //
-//   - The input is truncated.
-//   - The input is otherwise invalid (arbitrary corruption).
-//   - The passphrase does not match that which was used during encryption.
+// An error is returned under the same conditions as Inspect.
+func Disassemble(crypttext []byte) (salt [saltLen]byte, nounce [secretboxNounceLen]byte, sealedBox []byte, err error) {
+	header, err := Inspect(crypttext)
+	if err != nil {
+		return salt, nounce, nil, err
+	}
+
+	return header.Salt, header.Nounce, crypttext[HeaderLen : HeaderLen+header.SealedBoxLen], nil
+}
+
+// Inspect parses the unencrypted header of a sequence of bytes previously created with Encrypt, without
+// decrypting anything. No passphrase is required.
 //
-// There is no way to tell programatically whether an error is due to a bad passphrase or
-// for other reasons.
-func Decrypt(passphrase string, crypttext []byte) ([]byte, error) {
+// An error is returned if the input is truncated or the header is otherwise invalid.
+func Inspect(crypttext []byte) (Header, error) {
+	var header Header
+
+	if len(crypttext) < HeaderLen {
+		return header, ErrTruncated
+	}
+
 	cryptReader := bytes.NewReader(crypttext)
 
-	var salt [saltLen]byte
-	n, err := io.ReadFull(cryptReader, salt[:])
+	n, err := io.ReadFull(cryptReader, header.Salt[:])
 	if err != nil {
-		return nil, fmt.Errorf("input likely truncated while reading salt: %v", err)
+		return header, fmt.Errorf("input likely truncated while reading salt: %v", err)
 	}
-	if n != len(salt) {
-		return nil, fmt.Errorf("ReadFull() succeeded yet byte count was not as expected: %v", n)
+	if n != len(header.Salt) {
+		return header, fmt.Errorf("ReadFull() succeeded yet byte count was not as expected: %v", n)
 	}
 
-	var nounce [secretboxNounceLen]byte
-	n, err = io.ReadFull(cryptReader, nounce[:])
+	n, err = io.ReadFull(cryptReader, header.Nounce[:])
 	if err != nil {
-		return nil, fmt.Errorf("input likely truncated while reading nounce: %v", err)
+		return header, fmt.Errorf("input likely truncated while reading nounce: %v", err)
 	}
-	if n != len(nounce) {
-		return nil, fmt.Errorf("ReadFull() succeeded yet byte count was not as expected: %v", n)
+	if n != len(header.Nounce) {
+		return header, fmt.Errorf("ReadFull() succeeded yet byte count was not as expected: %v", n)
 	}
 
-	var sealedBoxLen int64
-	if err = binary.Read(cryptReader, binary.BigEndian, &sealedBoxLen); err != nil {
-		return nil, fmt.Errorf("input likely truncated while reading sealed box: %v", err)
+	if err = binary.Read(cryptReader, binary.BigEndian, &header.SealedBoxLen); err != nil {
+		return header, fmt.Errorf("input likely truncated while reading sealed box: %v", err)
+	}
+	if header.SealedBoxLen < 0 {
+		return header, errors.New("corrupt input; claimed length is negative")
 	}
-	if sealedBoxLen > int64(len(crypttext)) {
-		return nil, errors.New("truncated or corrupt input; claimed length greater than available input")
+	if header.SealedBoxLen < secretbox.Overhead {
+		return header, fmt.Errorf("corrupt input; implausibly small sealed box (claimed length %d is less than the minimum of %d)",
+			header.SealedBoxLen, secretbox.Overhead)
 	}
+	if header.SealedBoxLen > int64(cryptReader.Len()) {
+		return header, errors.New("truncated or corrupt input; claimed length greater than available input")
+	}
+
+	return header, nil
+}
 
-	sealedBox := make([]byte, sealedBoxLen)
-	n, err = io.ReadFull(cryptReader, sealedBox)
+// Decrypt decrypts a sequence of bytes previously created with Encrypt.
+//
+// Errors conditions include (but may not be limited to):
+//
+//   - The input is truncated. If it is too short to possibly be valid, the error is ErrTruncated.
+//   - The input is otherwise invalid (arbitrary corruption).
+//   - The passphrase does not match that which was used during encryption.
+//
+// There is no way to tell programatically whether an error is due to a bad passphrase or
+// for other reasons.
+func Decrypt(passphrase string, crypttext []byte) ([]byte, error) {
+	return DecryptWithKDF(DefaultKDF(), passphrase, crypttext)
+}
+
+// DecryptWithKDF is like Decrypt, except that the key is derived from the passphrase using kdf rather than
+// DefaultKDF. It decrypts data produced by EncryptWithKDF with the same KDF. Using any other KDF fails with
+// ErrAuthentication, just like a wrong passphrase.
+func DecryptWithKDF(kdf KDF, passphrase string, crypttext []byte) ([]byte, error) {
+	header, err := Inspect(crypttext)
 	if err != nil {
-		return nil, errors.New("truncated or corrupt input (while reading sealed box)")
-	}
-	if n != len(sealedBox) {
-		return nil, fmt.Errorf("ReadFull() succeeded yet byte count was not as expected: %v", n)
+		return nil, err
 	}
+	salt := header.Salt
+	nounce := header.Nounce
+	sealedBox := crypttext[HeaderLen : HeaderLen+header.SealedBoxLen]
 
-	secretKey, err := genKey(passphrase, salt[:])
+	secretKey, err := genKey(kdf, passphrase, salt[:])
 	if err != nil {
 		return nil, err
 	}
@@ -157,7 +381,7 @@ func Decrypt(passphrase string, crypttext []byte) ([]byte, error) {
 		secretKey,
 	)
 	if !success {
-		return nil, errors.New("corrupt input, tampered-with data, or bad passphrase")
+		return nil, ErrAuthentication
 	}
 
 	if plaintext == nil {
@@ -166,3 +390,56 @@ func Decrypt(passphrase string, crypttext []byte) ([]byte, error) {
 
 	return plaintext, nil
 }
+
+// DecryptTo is like Decrypt, except that the plaintext is written to w rather than returned. This allows
+// callers (such as HTTP servers) to avoid holding on to a copy of the plaintext.
+//
+// Since the format authenticates the sealed box as a whole, the plaintext is still materialized internally
+// before being written in one shot.
+//
+// Nothing is written to w unless the input is successfully authenticated. Returns the number of bytes written
+// to w and an error, if any.
+func DecryptTo(passphrase string, crypttext []byte, w io.Writer) (int64, error) {
+	plaintext, err := Decrypt(passphrase, crypttext)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(plaintext)
+	if err != nil {
+		return int64(n), fmt.Errorf("failed to write plaintext: %v", err)
+	}
+
+	return int64(n), nil
+}
+
+// DecryptBatch decrypts multiple sequences of bytes previously created with Encrypt, all using the same
+// passphrase.
+//
+// Each blob has its own salt so keys cannot be shared between blobs, but blobs are decrypted in parallel
+// across a pool of workers sized by the number of CPUs. The returned slices are parallel to blobs; for each
+// index, either the plaintext or the error is set.
+func DecryptBatch(passphrase string, blobs [][]byte) ([][]byte, []error) {
+	plaintexts := make([][]byte, len(blobs))
+	errs := make([]error, len(blobs))
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				plaintexts[i], errs[i] = Decrypt(passphrase, blobs[i])
+			}
+		}()
+	}
+
+	for i := range blobs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return plaintexts, errs
+}
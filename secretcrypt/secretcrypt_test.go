@@ -1,12 +1,95 @@
 package secretcrypt
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
 	"math/rand"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
 )
 
+// Builder constructs crypttexts field by field, so that tests can express malformed inputs declaratively rather
+// than by poking at byte offsets. Fields default to well-formed values: zeroed salt and nounce of the correct
+// length, an empty body and a declared length matching the body.
+type Builder struct {
+	salt        []byte
+	nounce      []byte
+	declaredLen *int64
+	body        []byte
+	junk        []byte
+}
+
+func NewBuilder() *Builder {
+	return &Builder{
+		salt:   make([]byte, saltLen),
+		nounce: make([]byte, secretboxNounceLen),
+	}
+}
+
+// WithSalt sets the salt, which need not be of the correct length.
+func (b *Builder) WithSalt(salt []byte) *Builder {
+	b.salt = salt
+	return b
+}
+
+// WithNonce sets the nounce, which need not be of the correct length.
+func (b *Builder) WithNonce(nounce []byte) *Builder {
+	b.nounce = nounce
+	return b
+}
+
+// WithDeclaredLen sets the sealed box length claimed by the header, overriding the length of the body.
+func (b *Builder) WithDeclaredLen(declaredLen int64) *Builder {
+	b.declaredLen = &declaredLen
+	return b
+}
+
+// WithBody sets the sealed box.
+func (b *Builder) WithBody(body []byte) *Builder {
+	b.body = body
+	return b
+}
+
+// WithJunk sets bytes to append after the sealed box.
+func (b *Builder) WithJunk(junk []byte) *Builder {
+	b.junk = junk
+	return b
+}
+
+func (b *Builder) Build() []byte {
+	declaredLen := int64(len(b.body))
+	if b.declaredLen != nil {
+		declaredLen = *b.declaredLen
+	}
+
+	var crypttext []byte
+	crypttext = append(crypttext, b.salt...)
+	crypttext = append(crypttext, b.nounce...)
+	var lenField [sealedBoxLenLen]byte
+	binary.BigEndian.PutUint64(lenField[:], uint64(declaredLen))
+	crypttext = append(crypttext, lenField[:]...)
+	crypttext = append(crypttext, b.body...)
+
+	return append(crypttext, b.junk...)
+}
+
+func TestBuilder(t *testing.T) {
+	var salt [saltLen]byte
+	var nounce [secretboxNounceLen]byte
+	copy(salt[:], "saltsalt")
+	copy(nounce[:], "nouncenouncenouncenounce")
+	body := make([]byte, secretbox.Overhead+4)
+
+	// Well-formed fields must produce exactly what Assemble does.
+	assert.Equal(t, Assemble(salt, nounce, body), NewBuilder().WithSalt(salt[:]).WithNonce(nounce[:]).WithBody(body).Build())
+}
+
 func passthrough(t *testing.T, passphrase string, plaintext []byte) {
 	crypted, err := Encrypt(passphrase, plaintext)
 	assert.NoError(t, err)
@@ -34,3 +117,434 @@ func TestEncryptDecryptDoesNotCorrupt(t *testing.T) {
 		passthrough(t, "testphrase", b)
 	}
 }
+
+func TestEstimateKeyDerivation(t *testing.T) {
+	estimate, err := EstimateKeyDerivation()
+	assert.NoError(t, err)
+	assert.True(t, estimate > 0)
+}
+
+func TestMeasureKeyDerivation(t *testing.T) {
+	elapsed, err := MeasureKeyDerivation(Params{N: 1024, R: 8, P: 1})
+	assert.NoError(t, err)
+	assert.True(t, elapsed > 0)
+
+	_, err = MeasureKeyDerivation(Params{N: 1000, R: 8, P: 1})
+	assert.Error(t, err)
+}
+
+func TestDecryptBatch(t *testing.T) {
+	first, err := Encrypt("testphrase", []byte("first"))
+	assert.NoError(t, err)
+	second, err := Encrypt("testphrase", []byte("second"))
+	assert.NoError(t, err)
+	other, err := Encrypt("otherphrase", []byte("other"))
+	assert.NoError(t, err)
+
+	plaintexts, errs := DecryptBatch("testphrase", [][]byte{first, second, other, {}})
+	assert.Len(t, plaintexts, 4)
+	assert.Len(t, errs, 4)
+
+	assert.NoError(t, errs[0])
+	assert.Equal(t, []byte("first"), plaintexts[0])
+	assert.NoError(t, errs[1])
+	assert.Equal(t, []byte("second"), plaintexts[1])
+	assert.Error(t, errs[2])
+	assert.Nil(t, plaintexts[2])
+	assert.Error(t, errs[3])
+	assert.Nil(t, plaintexts[3])
+}
+
+func TestDefaultKDF(t *testing.T) {
+	salt := []byte("saltsalt")
+
+	key, err := DefaultKDF().Derive("testphrase", salt, keyLen)
+	assert.NoError(t, err)
+	expected, err := scrypt.Key([]byte("testphrase"), salt, 32768, 8, 1, 32)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, key)
+
+	// Decrypt must derive keys the same way.
+	var nounce [secretboxNounceLen]byte
+	var keyArray [keyLen]byte
+	copy(keyArray[:], expected)
+	var saltArray [saltLen]byte
+	copy(saltArray[:], salt)
+	crypted := Assemble(saltArray, nounce, secretbox.Seal(nil, []byte("test"), &nounce, &keyArray))
+	plaintext, err := Decrypt("testphrase", crypted)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test"), plaintext)
+
+	_, err = ScryptKDF{Params: Params{N: 3, R: 8, P: 1}}.Derive("testphrase", salt, keyLen)
+	assert.Error(t, err)
+}
+
+// hashKDF is a cheap (and insecure) KDF for testing: the key is the SHA-256 hash of a prefix, the salt and the
+// passphrase, truncated or padded to keyLen.
+type hashKDF struct {
+	prefix string
+	err    error
+}
+
+func (k hashKDF) Derive(passphrase string, salt []byte, keyLen int) ([]byte, error) {
+	if k.err != nil {
+		return nil, k.err
+	}
+	sum := sha256.Sum256(append(append([]byte(k.prefix), salt...), passphrase...))
+	return append(sum[:], make([]byte, keyLen)...)[:keyLen], nil
+}
+
+// shortKDF derives keys which are too short.
+type shortKDF struct{}
+
+func (shortKDF) Derive(passphrase string, salt []byte, keyLen int) ([]byte, error) {
+	return make([]byte, keyLen-1), nil
+}
+
+func TestCustomKDF(t *testing.T) {
+	crypted, err := EncryptWithKDF(hashKDF{prefix: "a"}, "testphrase", []byte("test"))
+	assert.NoError(t, err)
+	assert.Equal(t, CiphertextLen(4), int64(len(crypted)))
+
+	plaintext, err := DecryptWithKDF(hashKDF{prefix: "a"}, "testphrase", crypted)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test"), plaintext)
+
+	// The KDF is not recorded, so decrypting with any other KDF looks like a wrong passphrase.
+	_, err = DecryptWithKDF(hashKDF{prefix: "b"}, "testphrase", crypted)
+	assert.True(t, errors.Is(err, ErrAuthentication))
+	_, err = Decrypt("testphrase", crypted)
+	assert.True(t, errors.Is(err, ErrAuthentication))
+
+	kdfErr := errors.New("kdf failure")
+	_, err = EncryptWithKDF(hashKDF{err: kdfErr}, "testphrase", []byte("test"))
+	assert.Equal(t, kdfErr, err)
+	_, err = DecryptWithKDF(hashKDF{err: kdfErr}, "testphrase", crypted)
+	assert.Equal(t, kdfErr, err)
+
+	_, err = EncryptWithKDF(shortKDF{}, "testphrase", []byte("test"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "31 bytes")
+}
+
+func TestScryptMemory(t *testing.T) {
+	assert.Equal(t, int64(32*1024*1024), ScryptMemory(DefaultParams()))
+	assert.Equal(t, int64(128*1024*8), ScryptMemory(Params{N: 1024, R: 8, P: 1}))
+}
+
+func TestEncryptDeterministicBytes(t *testing.T) {
+	salt := make([]byte, 8)
+	nounce := make([]byte, 24)
+
+	first, err := EncryptDeterministicBytes("testphrase", []byte("test"), salt, nounce)
+	assert.NoError(t, err)
+	second, err := EncryptDeterministicBytes("testphrase", []byte("test"), salt, nounce)
+	assert.NoError(t, err)
+	assert.Equal(t, first, second)
+
+	plaintext, err := Decrypt("testphrase", first)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test"), plaintext)
+
+	_, err = EncryptDeterministicBytes("testphrase", []byte("test"), salt[:7], nounce)
+	assert.Error(t, err)
+	_, err = EncryptDeterministicBytes("testphrase", []byte("test"), salt, append(nounce, 0))
+	assert.Error(t, err)
+}
+
+func TestDecryptTruncated(t *testing.T) {
+	crypted, err := Encrypt("testphrase", []byte("test"))
+	assert.NoError(t, err)
+
+	for _, l := range []int{0, 1, saltLen, saltLen + secretboxNounceLen, HeaderLen - 1} {
+		_, err = Decrypt("testphrase", crypted[:l])
+		assert.Equal(t, ErrTruncated, err)
+	}
+
+	// Truncation beyond the header is detected, but not as ErrTruncated.
+	_, err = Decrypt("testphrase", crypted[:len(crypted)-1])
+	assert.Error(t, err)
+	assert.NotEqual(t, ErrTruncated, err)
+}
+
+// TestBitFlipsAreRejected checks that flipping any single bit of a crypttext causes decryption to fail. Since
+// each attempt to decrypt performs an expensive key derivation, all bits of the length field (which mostly fail
+// before key derivation) but only the bits of the first and last byte of the other fields are flipped.
+func TestBitFlipsAreRejected(t *testing.T) {
+	crypted, err := Encrypt("testphrase", []byte("test"))
+	assert.NoError(t, err)
+
+	lenFieldStart := saltLen + secretboxNounceLen
+	var offsets []int
+	for offset := lenFieldStart; offset < HeaderLen; offset++ {
+		offsets = append(offsets, offset)
+	}
+	offsets = append(offsets,
+		0, saltLen-1, // salt
+		saltLen, lenFieldStart-1, // nounce
+		HeaderLen, len(crypted)-1, // sealed box
+	)
+
+	for _, offset := range offsets {
+		for bit := uint(0); bit < 8; bit++ {
+			flipped := append([]byte{}, crypted...)
+			flipped[offset] ^= 1 << bit
+
+			plaintext, err := Decrypt("testphrase", flipped)
+			assert.Error(t, err, "flipping bit %d of byte %d was not detected", bit, offset)
+			assert.Nil(t, plaintext)
+		}
+	}
+}
+
+func TestCiphertextLen(t *testing.T) {
+	for _, l := range []int{0, 1, 1000} {
+		crypted, err := Encrypt("testphrase", make([]byte, l))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(crypted)), CiphertextLen(int64(l)))
+	}
+}
+
+func TestInspect(t *testing.T) {
+	salt := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	nounce := make([]byte, 24)
+	nounce[0] = 42
+
+	crypted, err := EncryptDeterministicBytes("testphrase", []byte("test"), salt, nounce)
+	assert.NoError(t, err)
+
+	header, err := Inspect(crypted)
+	assert.NoError(t, err)
+	assert.Equal(t, salt, header.Salt[:])
+	assert.Equal(t, nounce, header.Nounce[:])
+	assert.Equal(t, int64(len(crypted)-HeaderLen), header.SealedBoxLen)
+
+	_, err = Inspect(crypted[:len(crypted)-1])
+	assert.Error(t, err)
+}
+
+// TestLengthFieldIsBigEndian pins the byte order of the sealed box length field, independently of host
+// byte order, since the format must never change.
+func TestLengthFieldIsBigEndian(t *testing.T) {
+	// Long enough for the length to need more than one byte, so that byte order matters.
+	plaintext := make([]byte, 1000)
+
+	crypted, err := Encrypt("testphrase", plaintext)
+	assert.NoError(t, err)
+
+	sealedBoxLen := len(crypted) - HeaderLen
+	expected := make([]byte, sealedBoxLenLen)
+	for i := range expected {
+		expected[i] = byte(sealedBoxLen >> (8 * uint(sealedBoxLenLen-1-i)))
+	}
+	assert.Equal(t, expected, crypted[saltLen+secretboxNounceLen:HeaderLen])
+
+	header, err := Inspect(crypted)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(sealedBoxLen), header.SealedBoxLen)
+
+	decrypted, err := Decrypt("testphrase", crypted)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+
+	// The same length in little-endian byte order must not be accepted.
+	swapped := append([]byte{}, crypted...)
+	for i := 0; i < sealedBoxLenLen; i++ {
+		swapped[saltLen+secretboxNounceLen+i] = expected[sealedBoxLenLen-1-i]
+	}
+	_, err = Decrypt("testphrase", swapped)
+	assert.Error(t, err)
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestDecryptTo(t *testing.T) {
+	crypted, err := Encrypt("testphrase", []byte("test"))
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	n, err := DecryptTo("testphrase", crypted, &buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), n)
+	assert.Equal(t, "test", buf.String())
+
+	// Nothing must be written on authentication failure.
+	buf.Reset()
+	_, err = DecryptTo("wrongphrase", crypted, &buf)
+	assert.Error(t, err)
+	assert.Equal(t, 0, buf.Len())
+
+	_, err = DecryptTo("testphrase", crypted, failingWriter{})
+	assert.Error(t, err)
+}
+
+func benchmarkCrypttext(b *testing.B) []byte {
+	crypted, err := Encrypt("testphrase", make([]byte, 1<<20))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return crypted
+}
+
+func BenchmarkDecrypt(b *testing.B) {
+	crypted := benchmarkCrypttext(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		plaintext, err := Decrypt("testphrase", crypted)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = ioutil.Discard.Write(plaintext); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecryptTo(b *testing.B) {
+	crypted := benchmarkCrypttext(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := DecryptTo("testphrase", crypted, ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestImplausiblySmallSealedBox(t *testing.T) {
+	crypted := NewBuilder().WithBody(make([]byte, 4)).Build()
+
+	_, err := Inspect(crypted)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "implausibly small sealed box")
+
+	_, err = Decrypt("testphrase", crypted)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "implausibly small sealed box")
+}
+
+func TestNegativeSealedBoxLen(t *testing.T) {
+	crypted := NewBuilder().WithDeclaredLen(-1).WithBody(make([]byte, secretbox.Overhead)).Build()
+
+	_, err := Inspect(crypted)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "claimed length is negative")
+
+	_, err = Decrypt("testphrase", crypted)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "claimed length is negative")
+}
+
+func TestTooLargeSealedBoxLen(t *testing.T) {
+	body := make([]byte, secretbox.Overhead)
+	for _, declaredLen := range []int64{secretbox.Overhead + 1, 1 << 62} {
+		crypted := NewBuilder().WithDeclaredLen(declaredLen).WithBody(body).Build()
+
+		_, err := Inspect(crypted)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "claimed length greater than available input")
+
+		_, err = Decrypt("testphrase", crypted)
+		assert.Error(t, err)
+	}
+}
+
+func TestTruncatedNounce(t *testing.T) {
+	crypted := NewBuilder().WithNonce(make([]byte, secretboxNounceLen-1)).WithBody(make([]byte, secretbox.Overhead)).Build()
+
+	// The missing byte shifts everything that follows, so the declared length no longer makes sense.
+	_, err := Inspect(crypted)
+	assert.Error(t, err)
+}
+
+func TestTrailingJunk(t *testing.T) {
+	crypted, err := Encrypt("testphrase", []byte("test"))
+	assert.NoError(t, err)
+	salt, nounce, sealedBox, err := Disassemble(crypted)
+	assert.NoError(t, err)
+
+	// Bytes beyond the declared sealed box are ignored, as they always have been.
+	withJunk := NewBuilder().WithSalt(salt[:]).WithNonce(nounce[:]).WithBody(sealedBox).WithJunk([]byte("junk")).Build()
+	plaintext, err := Decrypt("testphrase", withJunk)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test"), plaintext)
+}
+
+func TestAssembleDisassemble(t *testing.T) {
+	var salt [8]byte
+	var nounce [24]byte
+	copy(salt[:], "saltsalt")
+	copy(nounce[:], "nouncenouncenouncenounce")
+
+	// Key derivation and sealing performed the way external code would.
+	params := DefaultParams()
+	key, err := scrypt.Key([]byte("testphrase"), salt[:], params.N, params.R, params.P, 32)
+	assert.NoError(t, err)
+	var keyArray [32]byte
+	copy(keyArray[:], key)
+	sealedBox := secretbox.Seal(nil, []byte("test"), &nounce, &keyArray)
+
+	crypted := Assemble(salt, nounce, sealedBox)
+
+	plaintext, err := Decrypt("testphrase", crypted)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test"), plaintext)
+
+	deterministic, err := EncryptDeterministicBytes("testphrase", []byte("test"), salt[:], nounce[:])
+	assert.NoError(t, err)
+	assert.Equal(t, deterministic, crypted)
+
+	gotSalt, gotNounce, gotSealedBox, err := Disassemble(crypted)
+	assert.NoError(t, err)
+	assert.Equal(t, salt, gotSalt)
+	assert.Equal(t, nounce, gotNounce)
+	assert.Equal(t, sealedBox, gotSealedBox)
+
+	_, _, _, err = Disassemble(crypted[:len(crypted)-1])
+	assert.Error(t, err)
+}
+
+type countingLimiter struct {
+	acquired int
+	released int
+	err      error
+}
+
+func (l *countingLimiter) Acquire() error {
+	if l.err != nil {
+		return l.err
+	}
+	l.acquired++
+	return nil
+}
+
+func (l *countingLimiter) Release() {
+	l.released++
+}
+
+func TestLimiter(t *testing.T) {
+	l := &countingLimiter{}
+	SetLimiter(l)
+	defer SetLimiter(nil)
+
+	crypted, err := Encrypt("testphrase", []byte("test"))
+	assert.NoError(t, err)
+	_, err = Decrypt("testphrase", crypted)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, l.acquired)
+	assert.Equal(t, 2, l.released)
+
+	l.err = errors.New("too busy")
+	_, err = Decrypt("testphrase", crypted)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "too busy")
+	assert.Equal(t, 2, l.released)
+}
@@ -0,0 +1,125 @@
+// Package shamir implements Shamir's secret sharing, using HashiCorp Vault's implementation over GF(2^8) (vendored
+// as vaultshamir) for the underlying arithmetic.
+//
+// A secret is split into n shares such that any k of them are sufficient to reconstruct it, while fewer than k
+// reveal nothing about it. Each share is self-describing, so that combining too few shares, or shares from
+// different splits, fails rather than silently producing an incorrect secret:
+//
+//	threshold (1 byte) || set id (8 bytes) || vault share
+//
+// The threshold is k and the set id is chosen at random for each split. The vault share is the share of the
+// secret followed by the first checksumLen bytes of its SHA-256 hash, which is verified after combining.
+package shamir
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/scode/saltybox/shamir/internal/vaultshamir"
+)
+
+const (
+	shareMagic = "saltyboxshare1:"
+
+	setIDLen    = 8
+	headerLen   = 1 + setIDLen
+	checksumLen = 8
+)
+
+// Split splits secret into n shares, any k of which can be combined to reconstruct it.
+func Split(secret []byte, n int, k int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("cannot split an empty secret")
+	}
+	if k < 2 {
+		return nil, fmt.Errorf("threshold must be at least 2, was %d", k)
+	}
+	if n < k {
+		return nil, fmt.Errorf("number of shares (%d) must be at least the threshold (%d)", n, k)
+	}
+	if n > 255 {
+		return nil, fmt.Errorf("number of shares must be at most 255, was %d", n)
+	}
+
+	setID := make([]byte, setIDLen)
+	if _, err := rand.Read(setID); err != nil {
+		return nil, fmt.Errorf("rand.Read() should never fail, but did: %v", err)
+	}
+
+	checksum := sha256.Sum256(secret)
+	parts, err := vaultshamir.Split(append(append([]byte{}, secret...), checksum[:checksumLen]...), n, k)
+	if err != nil {
+		return nil, err
+	}
+
+	shares := make([][]byte, n)
+	for i, part := range parts {
+		shares[i] = append(append([]byte{byte(k)}, setID...), part...)
+	}
+
+	return shares, nil
+}
+
+// Combine reconstructs a secret from shares produced by Split. It fails if there are fewer shares than the
+// threshold they were split with, if they are not all from the same split, or if the reconstructed secret does
+// not match its checksum.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares given")
+	}
+	for _, share := range shares {
+		if len(share) < headerLen+checksumLen+2 {
+			return nil, errors.New("share too short")
+		}
+	}
+
+	threshold := int(shares[0][0])
+	setID := shares[0][1:headerLen]
+	parts := make([][]byte, len(shares))
+	for i, share := range shares {
+		if int(share[0]) != threshold || !bytes.Equal(share[1:headerLen], setID) {
+			return nil, errors.New("shares are from different splits")
+		}
+		parts[i] = share[headerLen:]
+	}
+	if len(shares) < threshold {
+		return nil, fmt.Errorf("%d shares given, but %d are required", len(shares), threshold)
+	}
+
+	combined, err := vaultshamir.Combine(parts)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := combined[:len(combined)-checksumLen]
+	checksum := sha256.Sum256(secret)
+	if !bytes.Equal(checksum[:checksumLen], combined[len(secret):]) {
+		return nil, errors.New("combined secret does not match its checksum; the shares are corrupt or mismatched")
+	}
+
+	return secret, nil
+}
+
+// ArmorShare returns a text representation of a share, suitable for transport.
+func ArmorShare(share []byte) string {
+	return shareMagic + base64.RawURLEncoding.EncodeToString(share)
+}
+
+// UnarmorShare parses a share previously armored with ArmorShare.
+func UnarmorShare(armored string) ([]byte, error) {
+	if !strings.HasPrefix(armored, shareMagic) {
+		return nil, errors.New("input unrecognized as a saltybox passphrase share")
+	}
+
+	share, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(armored, shareMagic))
+	if err != nil {
+		return nil, fmt.Errorf("base64 decoding failed: %s", err)
+	}
+
+	return share, nil
+}
@@ -0,0 +1,89 @@
+package shamir
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("correct horse battery staple")
+
+	shares, err := Split(secret, 5, 3)
+	assert.NoError(t, err)
+	assert.Len(t, shares, 5)
+
+	// Every subset of exactly three shares reconstructs the secret.
+	for i := 0; i < len(shares); i++ {
+		for j := i + 1; j < len(shares); j++ {
+			for k := j + 1; k < len(shares); k++ {
+				combined, err := Combine([][]byte{shares[i], shares[j], shares[k]})
+				assert.NoError(t, err)
+				assert.Equal(t, secret, combined)
+			}
+		}
+	}
+
+	// More than the threshold works too.
+	combined, err := Combine(shares)
+	assert.NoError(t, err)
+	assert.Equal(t, secret, combined)
+
+	// Fewer than the threshold is detected.
+	_, err = Combine(shares[:2])
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "2 shares given, but 3 are required")
+}
+
+func TestSplitInvalid(t *testing.T) {
+	_, err := Split([]byte{}, 5, 3)
+	assert.Error(t, err)
+	_, err = Split([]byte("x"), 5, 1)
+	assert.Error(t, err)
+	_, err = Split([]byte("x"), 2, 3)
+	assert.Error(t, err)
+	_, err = Split([]byte("x"), 256, 3)
+	assert.Error(t, err)
+}
+
+func TestCombineInvalid(t *testing.T) {
+	shares, err := Split([]byte("secret"), 3, 2)
+	assert.NoError(t, err)
+
+	_, err = Combine(nil)
+	assert.Error(t, err)
+	_, err = Combine(shares[:1])
+	assert.Error(t, err)
+	_, err = Combine([][]byte{shares[0], shares[0]})
+	assert.Error(t, err)
+	_, err = Combine([][]byte{shares[0], shares[1][:len(shares[1])-1]})
+	assert.Error(t, err)
+
+	// Shares from a different split of the same secret are rejected.
+	other, err := Split([]byte("secret"), 3, 2)
+	assert.NoError(t, err)
+	_, err = Combine([][]byte{shares[0], other[1]})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "different splits")
+
+	// As are corrupted shares.
+	corrupted := append([]byte{}, shares[1]...)
+	corrupted[headerLen] ^= 1
+	_, err = Combine([][]byte{shares[0], corrupted})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "checksum")
+}
+
+func TestArmor(t *testing.T) {
+	share := []byte{0, 1, 2, 255}
+
+	armored := ArmorShare(share)
+	assert.Equal(t, "saltyboxshare1:AAEC_w", armored)
+
+	unarmored, err := UnarmorShare(armored)
+	assert.NoError(t, err)
+	assert.Equal(t, share, unarmored)
+
+	_, err = UnarmorShare("saltybox1:AAEC_w")
+	assert.Error(t, err)
+}
@@ -0,0 +1,94 @@
+// Package stego hides arbitrary bytes in the least significant bits of an image.
+//
+// Data is stored one bit per color channel (red, green and blue; alpha is left untouched), in pixel order,
+// preceded by a 32 bit big endian length. This provides no confidentiality on its own and is meant to carry
+// data that has already been encrypted.
+package stego
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+)
+
+const (
+	lengthLen        = 4 // Length of the length prefix in number of bytes.
+	channelsPerPixel = 3
+)
+
+// Capacity returns the maximum number of bytes that can be embedded in an image of the given bounds.
+func Capacity(bounds image.Rectangle) int {
+	bits := bounds.Dx() * bounds.Dy() * channelsPerPixel
+	capacity := bits/8 - lengthLen
+	if capacity < 0 {
+		return 0
+	}
+
+	return capacity
+}
+
+// Embed returns a copy of cover with data embedded in it.
+//
+// An error is returned if cover is too small to hold data.
+func Embed(cover image.Image, data []byte) (*image.NRGBA, error) {
+	bounds := cover.Bounds()
+	if len(data) > Capacity(bounds) {
+		return nil, fmt.Errorf("cover image too small: can hold %d bytes but %d are needed", Capacity(bounds), len(data))
+	}
+
+	payload := make([]byte, lengthLen+len(data))
+	binary.BigEndian.PutUint32(payload, uint32(len(data)))
+	copy(payload[lengthLen:], data)
+
+	out := image.NewNRGBA(bounds)
+	bit := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(cover.At(x, y)).(color.NRGBA)
+			channels := []*uint8{&c.R, &c.G, &c.B}
+			for _, channel := range channels {
+				if bit < len(payload)*8 {
+					b := (payload[bit/8] >> (7 - uint(bit%8))) & 1
+					*channel = (*channel &^ 1) | b
+					bit++
+				}
+			}
+			out.SetNRGBA(x, y, c)
+		}
+	}
+
+	return out, nil
+}
+
+// Extract returns the data previously embedded in img by Embed.
+func Extract(img image.Image) ([]byte, error) {
+	bounds := img.Bounds()
+	bits := make([]byte, 0, bounds.Dx()*bounds.Dy()*channelsPerPixel)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			bits = append(bits, c.R&1, c.G&1, c.B&1)
+		}
+	}
+
+	readBytes := func(offset int, n int) []byte {
+		out := make([]byte, n)
+		for i := 0; i < n*8; i++ {
+			out[i/8] |= bits[offset*8+i] << (7 - uint(i%8))
+		}
+		return out
+	}
+
+	if len(bits) < lengthLen*8 {
+		return nil, errors.New("image too small to contain embedded data")
+	}
+
+	dataLen := binary.BigEndian.Uint32(readBytes(0, lengthLen))
+	if uint64(dataLen) > uint64(Capacity(bounds)) {
+		return nil, errors.New("image does not appear to contain embedded data; claimed length greater than capacity")
+	}
+
+	return readBytes(lengthLen, int(dataLen)), nil
+}
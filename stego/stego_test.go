@@ -0,0 +1,55 @@
+package stego
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func coverImage(w int, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: uint8(x + y), A: 255})
+		}
+	}
+
+	return img
+}
+
+func TestEmbedExtract(t *testing.T) {
+	cover := coverImage(32, 32)
+
+	embedded, err := Embed(cover, []byte("saltybox1:test"))
+	assert.NoError(t, err)
+
+	// Ensure the data survives a round trip through PNG encoding.
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, embedded))
+	decoded, err := png.Decode(&buf)
+	assert.NoError(t, err)
+
+	data, err := Extract(decoded)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("saltybox1:test"), data)
+}
+
+func TestEmbedEmpty(t *testing.T) {
+	embedded, err := Embed(coverImage(4, 4), []byte{})
+	assert.NoError(t, err)
+
+	data, err := Extract(embedded)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{}, data)
+}
+
+func TestEmbedTooSmall(t *testing.T) {
+	cover := coverImage(4, 4)
+
+	_, err := Embed(cover, make([]byte, Capacity(cover.Bounds())+1))
+	assert.Error(t, err)
+}
@@ -23,3 +23,9 @@ echo "updated data" > "${tmpdir}/updated_data.txt"
 echo -n test | ./saltybox --passphrase-stdin update -i "${tmpdir}/updated_data.txt" -o "${tmpdir}/hello-encrypted2.txt.salty"
 echo -n test | ./saltybox --passphrase-stdin decrypt -i "${tmpdir}/hello-encrypted2.txt.salty" -o "${tmpdir}/updated_data-decrypted.txt"
 diff "${tmpdir}/updated_data.txt" "${tmpdir}/updated_data-decrypted.txt"
+
+# --passphrase-trim does not apply to keyfiles
+printf 'secret\n' > "${tmpdir}/keyfile"
+./saltybox --passphrase-trim all-surrounding encrypt --keyfile "${tmpdir}/keyfile" -i testdata/hello.txt -o "${tmpdir}/hello-keyfile.txt.salty"
+printf 'secret\n' | ./saltybox --passphrase-stdin decrypt -i "${tmpdir}/hello-keyfile.txt.salty" -o "${tmpdir}/hello-keyfile-decrypted.txt"
+diff testdata/hello.txt "${tmpdir}/hello-keyfile-decrypted.txt"
@@ -2,20 +2,91 @@
 //
 // The armored form is free of whitespace (including newlines), safe to embed in URLs (other than possibly
 // its length) and safe to pass unescaped in a POSIX shell.
+//
+// The default encoding is unpadded URL-safe base64. Alternative encodings (see Encodings) are identified by
+// their own magic marker, and are auto-detected by Unwrap. Note that the "std" encoding uses the standard base64
+// alphabet and is therefore not safe to embed in URLs.
+//
+// The "pem" encoding (see WrapPEM) is the exception to all of the above: it is line-wrapped between BEGIN and
+// END lines, for tools and media (such as email) which expect PEM-like text.
 package varmor
 
 import (
+	"encoding/base32"
 	"encoding/base64"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"strings"
 )
 
 const (
 	magicPrefix = "saltybox"
 	v1Magic     = "saltybox1:"
+
+	utf8BOM = "\xef\xbb\xbf"
+
+	pemEncodingName = "pem"
+	pemType         = "SALTYBOX"
+	pemBegin        = "-----BEGIN " + pemType + "-----"
 )
 
+type codec interface {
+	EncodeToString(src []byte) string
+	DecodeString(s string) ([]byte, error)
+	EncodedLen(n int) int
+}
+
+type encoding struct {
+	name      string
+	magic     string
+	codecName string
+	codec     codec
+
+	// newDecoder returns a streaming decoder of the encoded data read from r.
+	newDecoder func(r io.Reader) io.Reader
+	// isBodyChar returns whether c may appear in an encoded body.
+	isBodyChar func(c byte) bool
+}
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// encodings is the registry of supported armor encodings. The first one is the default.
+var encodings = []encoding{
+	{
+		name: "url", magic: v1Magic, codecName: "base64", codec: base64.RawURLEncoding,
+		newDecoder: func(r io.Reader) io.Reader { return base64.NewDecoder(base64.RawURLEncoding, r) },
+		isBodyChar: func(c byte) bool { return isAlphanumeric(c) || c == '-' || c == '_' },
+	},
+	{
+		name: "std", magic: "saltybox1std:", codecName: "base64", codec: base64.RawStdEncoding,
+		newDecoder: func(r io.Reader) io.Reader { return base64.NewDecoder(base64.RawStdEncoding, r) },
+		isBodyChar: func(c byte) bool { return isAlphanumeric(c) || c == '+' || c == '/' },
+	},
+	{
+		name: "base32", magic: "saltybox1b32:", codecName: "base32", codec: base32NoPadding,
+		// The streaming base32 decoder requires padding, so it is restored.
+		newDecoder: func(r io.Reader) io.Reader {
+			return base32.NewDecoder(base32.StdEncoding, &padder{upstream: r, blockLen: 8})
+		},
+		isBodyChar: func(c byte) bool { return (c >= 'A' && c <= 'Z') || (c >= '2' && c <= '7') },
+	},
+}
+
+// maxMagicLen bounds how much input is examined for a magic marker when streaming.
+const maxMagicLen = 32
+
+// Encodings returns the names of all supported armor encodings, the default ("url") first.
+func Encodings() []string {
+	var names []string
+	for _, enc := range encodings {
+		names = append(names, enc.name)
+	}
+
+	return append(names, pemEncodingName)
+}
+
 // Wrap an array of bytes in armor, returning the resulting string.
 func Wrap(body []byte) string {
 	encoded := base64.RawURLEncoding.EncodeToString(body)
@@ -23,6 +94,67 @@ func Wrap(body []byte) string {
 	return fmt.Sprintf("%s%s", v1Magic, encoded)
 }
 
+// WrapWith is like Wrap, but uses the named encoding (one of those returned by Encodings).
+func WrapWith(encodingName string, body []byte) (string, error) {
+	if encodingName == pemEncodingName {
+		return WrapPEM(body), nil
+	}
+	for _, enc := range encodings {
+		if enc.name == encodingName {
+			return enc.magic + enc.codec.EncodeToString(body), nil
+		}
+	}
+
+	return "", fmt.Errorf("unsupported armor encoding %q; supported encodings are: %s", encodingName, strings.Join(Encodings(), ", "))
+}
+
+// WrappedLen returns the length of the string Wrap returns for a body of bodyLen bytes.
+func WrappedLen(bodyLen int) int {
+	return len(v1Magic) + base64.RawURLEncoding.EncodedLen(bodyLen)
+}
+
+// WrappedLenWith is like WrappedLen, but for WrapWith with the named encoding.
+func WrappedLenWith(encodingName string, bodyLen int) (int, error) {
+	if encodingName == pemEncodingName {
+		// Lines of at most 64 characters, each followed by a newline, between the BEGIN and END lines.
+		encodedLen := base64.StdEncoding.EncodedLen(bodyLen)
+		lines := (encodedLen + 63) / 64
+		return len(pemBegin) + 1 + encodedLen + lines + len("-----END "+pemType+"-----") + 1, nil
+	}
+	for _, enc := range encodings {
+		if enc.name == encodingName {
+			return len(enc.magic) + enc.codec.EncodedLen(bodyLen), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unsupported armor encoding %q; supported encodings are: %s", encodingName, strings.Join(Encodings(), ", "))
+}
+
+// WrapPEM wraps an array of bytes in PEM-like armor: line-wrapped standard base64 between
+// "-----BEGIN SALTYBOX-----" and "-----END SALTYBOX-----" lines, followed by a newline. Unwrap detects this form.
+func WrapPEM(body []byte) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: body}))
+}
+
+func isPEM(s string) bool {
+	return strings.HasPrefix(strings.TrimLeft(s, " \t\r\n"), pemBegin)
+}
+
+func unwrapPEM(s string) ([]byte, error) {
+	block, rest := pem.Decode([]byte(strings.TrimLeft(s, " \t\r\n")))
+	if block == nil {
+		return nil, errors.New("malformed PEM armor; likely truncated")
+	}
+	if block.Type != pemType {
+		return nil, fmt.Errorf("unexpected PEM block type %q", block.Type)
+	}
+	if strings.TrimSpace(string(rest)) != "" {
+		return nil, errors.New("unexpected data after PEM armor")
+	}
+
+	return block.Bytes, nil
+}
+
 // Unwrap an armored string.
 //
 // Errors conditions include:
@@ -30,23 +162,225 @@ func Wrap(body []byte) string {
 //   - The input is provably truncated.
 //   - Base64 decoding failure.
 //   - Input indicates a future version of of the format that we do not support.
-//   - Input does not appear to be the the result of Wrap().
+//   - Input does not appear to be the the result of Wrap() or WrapWith().
+//
+// A leading UTF-8 byte order mark, as prepended by some Windows editors, is ignored. Input in the PEM-like form
+// produced by WrapPEM is also accepted.
 func Unwrap(varmoredBody string) ([]byte, error) {
+	varmoredBody = strings.TrimPrefix(varmoredBody, utf8BOM)
+
+	if isPEM(varmoredBody) {
+		return unwrapPEM(varmoredBody)
+	}
+
 	if len(varmoredBody) < len(v1Magic) {
 		return nil, errors.New("input size smaller than magic marker; likely truncated")
 	}
 
-	if strings.HasPrefix(varmoredBody, v1Magic) {
-		armoredBody := strings.TrimPrefix(varmoredBody, v1Magic)
-		body, err := base64.RawURLEncoding.DecodeString(armoredBody)
-		if err != nil {
-			return nil, fmt.Errorf("base64 decoding failed: %s", err)
+	for _, enc := range encodings {
+		if strings.HasPrefix(varmoredBody, enc.magic) {
+			armoredBody := strings.TrimPrefix(varmoredBody, enc.magic)
+			body, err := enc.codec.DecodeString(armoredBody)
+			if err != nil {
+				return nil, fmt.Errorf("%s decoding failed: %s", enc.codecName, err)
+			}
+
+			return body, nil
+		}
+	}
+
+	if strings.HasPrefix(varmoredBody, magicPrefix) {
+		return nil, errors.New("input claims to be saltybox, but not a version we support")
+	} else {
+		return nil, errors.New("input unrecognized as saltybox data")
+	}
+}
+
+// IsSaltybox returns whether s appears to be armored saltybox data, in any supported encoding. This only checks
+// the magic marker; it does not validate the body.
+func IsSaltybox(s string) bool {
+	_, ok := EncodingOf(s)
+	return ok
+}
+
+// EncodingOf returns the name of the encoding (one of those returned by Encodings) that s is armored with,
+// judging only by its magic marker. If s does not appear to be armored saltybox data, ok is false.
+func EncodingOf(s string) (name string, ok bool) {
+	s = strings.TrimPrefix(s, utf8BOM)
+	if isPEM(s) {
+		return pemEncodingName, true
+	}
+	for _, enc := range encodings {
+		if strings.HasPrefix(s, enc.magic) {
+			return enc.name, true
 		}
+	}
+
+	return "", false
+}
 
+// UnwrapStrict is like Unwrap, except that only the canonical armored form of the body is accepted.
+//
+// Unwrap tolerates some variations (such as non-zero trailing bits in the final character, or embedded newlines)
+// which means several distinct strings may decode to the same body. UnwrapStrict rejects any input that differs
+// from what Wrap/WrapWith would have produced for the decoded body, including one with a byte order mark.
+func UnwrapStrict(varmoredBody string) ([]byte, error) {
+	body, err := Unwrap(varmoredBody)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, enc := range encodings {
+		if enc.magic+enc.codec.EncodeToString(body) == varmoredBody {
+			return body, nil
+		}
+	}
+	if WrapPEM(body) == varmoredBody {
 		return body, nil
-	} else if strings.HasPrefix(varmoredBody, magicPrefix) {
+	}
+
+	return nil, errors.New("non-canonical encoding")
+}
+
+// UnwrapFrom unwraps armored data read incrementally from r, returning a reader of the decoded body. All
+// encodings other than "pem" are supported; PEM-like input is rejected and must be passed to Unwrap instead.
+//
+// ASCII whitespace (including newlines) anywhere in the input is ignored, so that line-wrapped armor can be
+// decoded without buffering the entire input. The magic marker is validated before returning; errors in the
+// body surface as errors from the returned reader.
+func UnwrapFrom(r io.Reader) (io.Reader, error) {
+	filtered := &whitespaceFilter{upstream: r}
+
+	// Read up to and including the colon ending the magic marker, one byte at a time so as not to consume any of
+	// the body.
+	var magic []byte
+	c := make([]byte, 1)
+	for len(magic) < maxMagicLen && (len(magic) == 0 || magic[len(magic)-1] != ':') {
+		if _, err := io.ReadFull(filtered, c); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read magic marker: %s", err)
+		}
+		magic = append(magic, c[0])
+	}
+
+	for _, enc := range encodings {
+		if string(magic) == enc.magic {
+			return enc.newDecoder(filtered), nil
+		}
+	}
+	for _, enc := range encodings {
+		if strings.HasPrefix(enc.magic, string(magic)) {
+			return nil, errors.New("input size smaller than magic marker; likely truncated")
+		}
+	}
+	if strings.HasPrefix(string(magic), "-----") {
+		return nil, errors.New("PEM-like armor cannot be unwrapped incrementally")
+	} else if strings.HasPrefix(string(magic), magicPrefix) {
 		return nil, errors.New("input claims to be saltybox, but not a version we support")
 	} else {
 		return nil, errors.New("input unrecognized as saltybox data")
 	}
 }
+
+// whitespaceFilter is a reader which drops all ASCII whitespace read from upstream.
+type whitespaceFilter struct {
+	upstream io.Reader
+}
+
+func (f *whitespaceFilter) Read(p []byte) (int, error) {
+	for {
+		n, err := f.upstream.Read(p)
+
+		kept := 0
+		for _, c := range p[:n] {
+			if !isASCIIWhitespace(c) {
+				p[kept] = c
+				kept++
+			}
+		}
+
+		if kept > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
+
+// padder is a reader which appends '=' padding to what is read from upstream, up to a multiple of blockLen bytes.
+type padder struct {
+	upstream io.Reader
+	blockLen int
+	n        int
+	padding  int
+	eof      bool
+}
+
+func (p *padder) Read(b []byte) (int, error) {
+	if !p.eof {
+		n, err := p.upstream.Read(b)
+		p.n += n
+		if err != io.EOF {
+			return n, err
+		}
+		p.eof = true
+		p.padding = (p.blockLen - p.n%p.blockLen) % p.blockLen
+		if n > 0 {
+			return n, nil
+		}
+	}
+
+	if p.padding == 0 {
+		return 0, io.EOF
+	}
+	n := 0
+	for ; n < len(b) && p.padding > 0; n++ {
+		b[n] = '='
+		p.padding--
+	}
+
+	return n, nil
+}
+
+func isASCIIWhitespace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+// FindBlob locates the first armored blob within s, which may contain arbitrary surrounding text. Blobs in any
+// encoding other than "pem" are found; PEM-like armor spans several lines and is not searched for.
+//
+// On success, s[start:end] is the complete armored blob (including its magic marker) suitable for
+// passing to Unwrap, and version is the format version of the blob. Candidates whose body does not decode are
+// skipped.
+func FindBlob(s string) (start, end int, version int, ok bool) {
+	offset := 0
+	for {
+		var enc *encoding
+		start = -1
+		for i := range encodings {
+			idx := strings.Index(s[offset:], encodings[i].magic)
+			if idx >= 0 && (start < 0 || offset+idx < start) {
+				start = offset + idx
+				enc = &encodings[i]
+			}
+		}
+		if enc == nil {
+			return 0, 0, 0, false
+		}
+
+		bodyStart := start + len(enc.magic)
+		end = bodyStart
+		for end < len(s) && enc.isBodyChar(s[end]) {
+			end++
+		}
+
+		if _, err := enc.codec.DecodeString(s[bodyStart:end]); err == nil {
+			return start, end, 1, true
+		}
+
+		offset = bodyStart
+	}
+}
+
+func isAlphanumeric(c byte) bool {
+	return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9')
+}
@@ -1,7 +1,10 @@
 package varmor
 
 import (
+	"io"
+	"io/ioutil"
 	"math/rand"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -64,3 +67,322 @@ func TestAllByteValues(t *testing.T) {
 		"saltybox1:AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8gISIjJCUmJygpKissLS4vMDEyMzQ1Njc4OTo7PD0-P0BBQkNERUZHSElKS0xNTk9QUVJTVFVWV1hZWltcXV5fYGFiY2RlZmdoaWprbG1ub3BxcnN0dXZ3eHl6e3x9fn-AgYKDhIWGh4iJiouMjY6PkJGSk5SVlpeYmZqbnJ2en6ChoqOkpaanqKmqq6ytrq-wsbKztLW2t7i5uru8vb6_wMHCw8TFxsfIycrLzM3Oz9DR0tPU1dbX2Nna29zd3t_g4eLj5OXm5-jp6uvs7e7v8PHy8_T19vf4-fr7_P3-_w",
 		wrapped)
 }
+
+func TestFindBlob(t *testing.T) {
+	wrapped := Wrap([]byte("test"))
+	s := "some text before " + wrapped + " and after"
+
+	start, end, version, ok := FindBlob(s)
+	assert.True(t, ok)
+	assert.Equal(t, 1, version)
+	assert.Equal(t, len("some text before "), start)
+	assert.Equal(t, wrapped, s[start:end])
+
+	b, err := Unwrap(s[start:end])
+	assert.NoError(t, err)
+	assert.Equal(t, "test", string(b))
+}
+
+func TestFindBlobSkipsInvalid(t *testing.T) {
+	wrapped := Wrap([]byte("test"))
+	s := "saltybox1:A " + wrapped
+
+	start, end, _, ok := FindBlob(s)
+	assert.True(t, ok)
+	assert.Equal(t, wrapped, s[start:end])
+}
+
+func TestFindBlobEncodings(t *testing.T) {
+	for _, name := range []string{"url", "std", "base32"} {
+		wrapped, err := WrapWith(name, []byte("test"))
+		assert.NoError(t, err)
+		s := "saltybox1:A then " + wrapped + ", and saltybox1:dGVzdA after"
+
+		start, end, version, ok := FindBlob(s)
+		assert.True(t, ok, name)
+		assert.Equal(t, 1, version)
+		assert.Equal(t, wrapped, s[start:end], name)
+	}
+}
+
+func TestFindBlobNotFound(t *testing.T) {
+	_, _, _, ok := FindBlob("nothing to see here")
+	assert.False(t, ok)
+}
+
+// chunkedReader yields its data a few bytes at a time.
+type chunkedReader struct {
+	data      []byte
+	chunkSize int
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+
+	n := r.chunkSize
+	if n > len(p) {
+		n = len(p)
+	}
+	if n > len(r.data) {
+		n = len(r.data)
+	}
+	copy(p, r.data[:n])
+	r.data = r.data[n:]
+
+	return n, nil
+}
+
+func TestUnwrapFromLineWrapped(t *testing.T) {
+	rnd := rand.New(rand.NewSource(0))
+	body := make([]byte, 1000)
+	_, err := rnd.Read(body)
+	assert.NoError(t, err)
+
+	wrapped := Wrap(body)
+	var lines []string
+	for len(wrapped) > 0 {
+		n := 7
+		if n > len(wrapped) {
+			n = len(wrapped)
+		}
+		lines = append(lines, wrapped[:n])
+		wrapped = wrapped[n:]
+	}
+	armored := strings.Join(lines, "\r\n") + "\n"
+
+	for _, chunkSize := range []int{1, 2, 3, 5, 64} {
+		r, err := UnwrapFrom(&chunkedReader{data: []byte(armored), chunkSize: chunkSize})
+		assert.NoError(t, err)
+
+		unwrapped, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, body, unwrapped)
+	}
+}
+
+func TestUnwrapFromEncodings(t *testing.T) {
+	rnd := rand.New(rand.NewSource(0))
+	for _, n := range []int{0, 1, 2, 3, 4, 5, 1000} {
+		body := make([]byte, n)
+		_, err := rnd.Read(body)
+		assert.NoError(t, err)
+
+		for _, name := range Encodings() {
+			wrapped, err := WrapWith(name, body)
+			assert.NoError(t, err)
+
+			r, err := UnwrapFrom(&chunkedReader{data: []byte(wrapped), chunkSize: 3})
+			if name == "pem" {
+				assert.Error(t, err)
+				continue
+			}
+			assert.NoError(t, err, name)
+
+			unwrapped, err := ioutil.ReadAll(r)
+			assert.NoError(t, err, name)
+			assert.Equal(t, body, unwrapped, "encoding %s, length %d", name, n)
+		}
+	}
+}
+
+func TestUnwrapFromErrors(t *testing.T) {
+	_, err := UnwrapFrom(strings.NewReader("salty"))
+	assert.Error(t, err)
+	assert.Equal(t, "input size smaller than magic marker; likely truncated", err.Error())
+
+	_, err = UnwrapFrom(strings.NewReader("saltybox999999:..."))
+	assert.Error(t, err)
+	assert.Equal(t, "input claims to be saltybox, but not a version we support", err.Error())
+
+	_, err = UnwrapFrom(strings.NewReader("something not looking like saltybox data"))
+	assert.Error(t, err)
+	assert.Equal(t, "input unrecognized as saltybox data", err.Error())
+
+	r, err := UnwrapFrom(strings.NewReader("saltybox1:!!!!"))
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	assert.Error(t, err)
+
+	// No base32 body can have a length of 1, 3 or 6 modulo 8.
+	r, err = UnwrapFrom(strings.NewReader("saltybox1b32:AAA"))
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	assert.Error(t, err)
+
+	_, err = UnwrapFrom(strings.NewReader("saltybox1std"))
+	assert.Error(t, err)
+	assert.Equal(t, "input size smaller than magic marker; likely truncated", err.Error())
+}
+
+func TestEncodings(t *testing.T) {
+	assert.Equal(t, []string{"url", "std", "base32", "pem"}, Encodings())
+
+	allBytes := make([]byte, 256)
+	for i := 0; i <= 255; i++ {
+		allBytes[i] = byte(i)
+	}
+
+	prefixes := map[string]string{
+		"url":    "saltybox1:",
+		"std":    "saltybox1std:",
+		"base32": "saltybox1b32:",
+		"pem":    "-----BEGIN SALTYBOX-----\n",
+	}
+	for name, prefix := range prefixes {
+		wrapped, err := WrapWith(name, allBytes)
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(wrapped, prefix))
+
+		unwrapped, err := Unwrap(wrapped)
+		assert.NoError(t, err)
+		assert.Equal(t, allBytes, unwrapped)
+	}
+
+	urlWrapped, err := WrapWith("url", allBytes)
+	assert.NoError(t, err)
+	assert.Equal(t, Wrap(allBytes), urlWrapped)
+
+	_, err = WrapWith("rot13", allBytes)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "url, std, base32, pem")
+}
+
+func TestUnwrapStrict(t *testing.T) {
+	for _, name := range Encodings() {
+		wrapped, err := WrapWith(name, []byte("test"))
+		assert.NoError(t, err)
+
+		body, err := UnwrapStrict(wrapped)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("test"), body)
+	}
+
+	// Non-zero trailing bits in the final character are tolerated by Unwrap but not by UnwrapStrict.
+	assert.Equal(t, "saltybox1:AA", Wrap([]byte{0}))
+	body, err := Unwrap("saltybox1:AB")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0}, body)
+	_, err = UnwrapStrict("saltybox1:AB")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "non-canonical")
+
+	// Same for embedded and trailing newlines.
+	_, err = Unwrap("saltybox1:A\nA\n")
+	assert.NoError(t, err)
+	_, err = UnwrapStrict("saltybox1:A\nA\n")
+	assert.Error(t, err)
+
+	// Errors from Unwrap are passed through.
+	_, err = UnwrapStrict("saltybox1:A")
+	assert.Error(t, err)
+	_, err = UnwrapStrict("nonsense")
+	assert.Error(t, err)
+}
+
+func TestUnwrapBOM(t *testing.T) {
+	wrapped := Wrap([]byte("test"))
+
+	body, err := Unwrap("\xef\xbb\xbf" + wrapped)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test"), body)
+
+	_, err = UnwrapStrict("\xef\xbb\xbf" + wrapped)
+	assert.Error(t, err)
+
+	// Only a leading BOM is tolerated.
+	_, err = Unwrap("\xef\xbb\xbf\xef\xbb\xbf" + wrapped)
+	assert.Error(t, err)
+	_, err = Unwrap("\xef\xbb\xbfnot saltybox data")
+	assert.Error(t, err)
+}
+
+func TestIsSaltybox(t *testing.T) {
+	for _, name := range Encodings() {
+		wrapped, err := WrapWith(name, []byte("test"))
+		assert.NoError(t, err)
+		assert.True(t, IsSaltybox(wrapped))
+	}
+	assert.True(t, IsSaltybox("\xef\xbb\xbf"+Wrap([]byte("test"))))
+
+	assert.False(t, IsSaltybox(""))
+	assert.False(t, IsSaltybox("saltybox"))
+	assert.False(t, IsSaltybox("saltybox999:AAAA"))
+	assert.False(t, IsSaltybox("plain text"))
+}
+
+func TestEncodingOf(t *testing.T) {
+	for _, name := range Encodings() {
+		wrapped, err := WrapWith(name, []byte("test"))
+		assert.NoError(t, err)
+
+		encoding, ok := EncodingOf(wrapped)
+		assert.True(t, ok)
+		assert.Equal(t, name, encoding)
+	}
+
+	_, ok := EncodingOf("plain text")
+	assert.False(t, ok)
+}
+
+func TestWrapPEM(t *testing.T) {
+	body := make([]byte, 100)
+	rand.New(rand.NewSource(0)).Read(body)
+
+	wrapped := WrapPEM(body)
+	lines := strings.Split(wrapped, "\n")
+	assert.Equal(t, "-----BEGIN SALTYBOX-----", lines[0])
+	assert.Equal(t, "-----END SALTYBOX-----", lines[len(lines)-2])
+	assert.Equal(t, "", lines[len(lines)-1])
+	for _, line := range lines {
+		assert.True(t, len(line) <= 64)
+	}
+
+	// Surrounding whitespace (such as when pasted into an email), CRLF line endings and a BOM are tolerated.
+	for _, variant := range []string{
+		wrapped,
+		"\n  " + wrapped + "\n\n",
+		strings.ReplaceAll(wrapped, "\n", "\r\n"),
+		"\xef\xbb\xbf" + wrapped,
+	} {
+		unwrapped, err := Unwrap(variant)
+		assert.NoError(t, err)
+		assert.Equal(t, body, unwrapped)
+	}
+
+	encoding, ok := EncodingOf(wrapped)
+	assert.True(t, ok)
+	assert.Equal(t, "pem", encoding)
+	assert.True(t, IsSaltybox(wrapped))
+
+	_, err := UnwrapStrict(wrapped)
+	assert.NoError(t, err)
+	_, err = UnwrapStrict("\n" + wrapped)
+	assert.Error(t, err)
+
+	_, err = Unwrap(wrapped[:len(wrapped)/2])
+	assert.Error(t, err)
+	_, err = Unwrap(wrapped + "trailing junk")
+	assert.Error(t, err)
+	_, err = Unwrap(strings.ReplaceAll(wrapped, "SALTYBOX", "CERTIFICATE"))
+	assert.Error(t, err)
+}
+
+func TestWrappedLen(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 3, 4, 47, 48, 49, 100, 1000} {
+		body := make([]byte, n)
+		assert.Equal(t, len(Wrap(body)), WrappedLen(n), "length %d", n)
+
+		for _, name := range Encodings() {
+			wrapped, err := WrapWith(name, body)
+			assert.NoError(t, err)
+			l, err := WrappedLenWith(name, n)
+			assert.NoError(t, err)
+			assert.Equal(t, len(wrapped), l, "encoding %s, length %d", name, n)
+		}
+	}
+
+	_, err := WrappedLenWith("rot13", 1)
+	assert.Error(t, err)
+}